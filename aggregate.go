@@ -4,6 +4,7 @@ import (
 	"strconv"
 	"os"
 	"fmt"
+	"strings"
 )
 
 
@@ -35,14 +36,20 @@ func (gd *GetDeepExpression) Setup(fname string, args []Expression) (err os.Erro
 }
 
 func (gd *GetDeepExpression) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	result, _, err = gd.Lookup(data)
+	return
+}
+
+// Both a missing field and a null one evaluate to nil. present tells them apart.
+func (gd *GetDeepExpression) Lookup(data JSONData) (result interface{}, present bool, err os.Error) {
 	key, err := gd.expr.Evaluate(data)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if key, ok := key.(string); key == "" || !ok {
-		return nil, fmt.Errorf("Expected non-empty string. Was type %T \"%v\"", key, key)
+		return nil, false, fmt.Errorf("Expected non-empty string. Was type %T \"%v\"", key, key)
 	}
-	result, _ = GetDeep(key.(string), data)
+	result, present = GetDeep(key.(string), data)
 	return
 }
 
@@ -72,13 +79,18 @@ func (a *AsClause) Setup(fname string, args []Expression) (err os.Error) {
 
 
 func (e *AsClause) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	result, _, err = e.Lookup(data)
+	return
+}
+
+func (e *AsClause) Lookup(data JSONData) (result interface{}, present bool, err os.Error) {
 	// Store the result of evaluating the alias, so it can be used by String() 
 	// This may prove to be unwise, but errors evaluating the alias are ignored,
 	// 'cause there's not much we can do about them.
 	aliasResult, _ := e.alias.Evaluate(data)
 	e.aliasResult, _ = aliasResult.(string)
 
-	return e.expr.Evaluate(data)
+	return lookup(e.expr, data)
 }
 
 func (e *AsClause) String() (result string) {
@@ -86,7 +98,9 @@ func (e *AsClause) String() (result string) {
 }
 
 /*
- * Subtract(expr1, expr2 float64) -> float64
+ * Add(a, b), Subtract(a, b), Multiply(a, b), Divide(a, b) -> number
+ *
+ * Or a + b, a - b, a * b and a / b. Ints give ints, except when divided.
  */
 
 type ArithmeticOperator struct {
@@ -115,26 +129,251 @@ func (o *ArithmeticOperator) Setup(fname string, args []Expression) (err os.Erro
 }
 
 func (o *ArithmeticOperator) Evaluate(data JSONData) (result interface{}, err os.Error) {
-	val1, err1 := o.expr1.Evaluate(data)
-	val2, err2 := o.expr2.Evaluate(data)
-	if err1 != nil {
-		return nil, fmt.Errorf("Expression 1 could not be evaluated, %v", err2)
-	}
-	if err2 != nil {
-		return nil, fmt.Errorf("Expression 1 could not be evaluated, %v", err2)
+	val1, err := o.expr1.Evaluate(data)
+	if err != nil {
+		return nil, fmt.Errorf("Expression 1 could not be evaluated, %v", err)
 	}
-	val1, ok1 := val1.(float64)
-	val2, ok2 := val2.(float64)
-	if !ok1 {
-		return nil, fmt.Errorf("Subtract expects a float64, Expression 1 was type %T, val %v", val1, val1)
+	val2, err := o.expr2.Evaluate(data)
+	if err != nil {
+		return nil, fmt.Errorf("Expression 2 could not be evaluated, %v", err)
 	}
-	if !ok2 {
-		return nil, fmt.Errorf("Subtract expects a float64, Expression 2 was type %T, val %v", val2, val2)
+	result, ok := arithmetic(o.fname, val1, val2)
+	if !ok {
+		return nil, fmt.Errorf("%v expects numbers, got %T %v and %T %v", o.fname, val1, val1, val2, val2)
 	}
-
-	return arithmeticOperators[o.fname](val1.(float64), val2.(float64)), nil
+	return result, nil
 }
 
 func (o *ArithmeticOperator) String() string {
 	return fmt.Sprintf("%v(%v,%v)", o.fname, o.expr1, o.expr2)
 }
+
+/*
+ * Eq(a, b) or a == b, Ne(a, b) or a != b, Lt(a, b) or a < b, Le(a, b) or a <= b, Gt(a, b) or a > b,
+ * Ge(a, b) or a >= b -> bool
+ *
+ * Numbers compare by value, whether they're ints from literals or float64s from JSON, and strings compare
+ * lexically, and bools can only be tested for equality. A missing (nil) value equals only another nil, and is
+ * neither less nor more than anything. Comparing mismatched types in any way, like a string against a number, is
+ * an error.
+ */
+type ComparisonOperator struct {
+	expr1 Expression
+	expr2 Expression
+	fname string
+}
+
+var comparisonSymbols = map[string]string{"Eq": "==", "Ne": "!=", "Lt": "<", "Le": "<=", "Gt": ">", "Ge": ">="}
+
+func (c *ComparisonOperator) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 2 {
+		return fmt.Errorf("%v expects two arguments, the expressions to compare", fname)
+	}
+	if _, ok := comparisonSymbols[fname]; !ok {
+		return fmt.Errorf("%v is not a supported ComparisonOperator", fname)
+	}
+	c.expr1, c.expr2 = args[0], args[1]
+	c.fname = fname
+	return nil
+}
+
+func (c *ComparisonOperator) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	val1, err := c.expr1.Evaluate(data)
+	if err != nil {
+		return nil, err
+	}
+	val2, err := c.expr2.Evaluate(data)
+	if err != nil {
+		return nil, err
+	}
+	if !isScalar(val1) || !isScalar(val2) {
+		return nil, fmt.Errorf("%v can't compare a %T with a %T", c, val1, val2)
+	}
+
+	order, ordered := compareScalars(val1, val2)
+	if !ordered {
+		_, bool1 := val1.(bool)
+		_, bool2 := val2.(bool)
+		equatable := val1 == nil || val2 == nil || (bool1 && bool2)
+		switch {
+		case equatable && c.fname == "Eq":
+			return val1 == val2, nil
+		case equatable && c.fname == "Ne":
+			return val1 != val2, nil
+		case val1 == nil || val2 == nil:
+			return false, nil
+		case bool1 && bool2:
+			return nil, fmt.Errorf("%v can only order two numbers or two strings, got %T %v and %T %v", c, val1, val1, val2, val2)
+		}
+		return nil, fmt.Errorf("%v can't compare a %T %v with a %T %v", c, val1, val1, val2, val2)
+	}
+
+	switch c.fname {
+	case "Eq":
+		return order == 0, nil
+	case "Ne":
+		return order != 0, nil
+	case "Lt":
+		return order < 0, nil
+	case "Le":
+		return order <= 0, nil
+	case "Gt":
+		return order > 0, nil
+	}
+	return order >= 0, nil
+}
+
+func (c *ComparisonOperator) String() string {
+	return fmt.Sprintf("%v %s %v", parenthesize(c.expr1), comparisonSymbols[c.fname], parenthesize(c.expr2))
+}
+
+// Orders two numbers by value, or two strings lexically, as -1, 0 or 1. Nothing else can be ordered.
+func compareScalars(a, b interface{}) (order int, ok bool) {
+	if num1, ok := numberValue(a); ok {
+		num2, ok := numberValue(b)
+		switch {
+		case !ok:
+			return 0, false
+		case num1 < num2:
+			return -1, true
+		case num1 > num2:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	str1, ok1 := a.(string)
+	str2, ok2 := b.(string)
+	switch {
+	case !ok1 || !ok2:
+		return 0, false
+	case str1 < str2:
+		return -1, true
+	case str1 > str2:
+		return 1, true
+	}
+	return 0, true
+}
+
+// Whether a value can be compared with ==. JSON objects and arrays can't.
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case nil, bool, string, int, float64:
+		return true
+	}
+	return false
+}
+
+/*
+ * And(a, b, ...) or a and b, Or(a, b, ...) or a or b, Not(a) or not a -> bool
+ *
+ * The operands have to be bools. And and Or go left to right, and stop as soon as the answer is decided, so
+ * later operands (and any errors evaluating them) are skipped.
+ */
+type BooleanOperator struct {
+	args  []Expression
+	fname string
+}
+
+func (b *BooleanOperator) Setup(fname string, args []Expression) (err os.Error) {
+	switch {
+	case fname == "Not" && len(args) != 1:
+		return fmt.Errorf("Not expects one argument, a bool")
+	case (fname == "And" || fname == "Or") && len(args) < 2:
+		return fmt.Errorf("%s expects two or more arguments, all bools", fname)
+	case fname != "Not" && fname != "And" && fname != "Or":
+		return fmt.Errorf("%v is not a supported BooleanOperator", fname)
+	}
+	b.args = args
+	b.fname = fname
+	return nil
+}
+
+func (b *BooleanOperator) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	if b.fname == "Not" {
+		value, err := evaluateBool(b.fname, b.args[0], data)
+		if err != nil {
+			return nil, err
+		}
+		return !value, nil
+	}
+
+	// And is decided by the first false, Or by the first true
+	decider := b.fname == "Or"
+	for _, arg := range b.args {
+		value, err := evaluateBool(b.fname, arg, data)
+		if err != nil {
+			return nil, err
+		}
+		if value == decider {
+			return decider, nil
+		}
+	}
+	return !decider, nil
+}
+
+func (b *BooleanOperator) String() string {
+	if b.fname == "Not" {
+		return fmt.Sprintf("not %v", parenthesize(b.args[0]))
+	}
+	operands := []string{}
+	for _, arg := range b.args {
+		operands = append(operands, parenthesize(arg))
+	}
+	return strings.Join(operands, " "+strings.ToLower(b.fname)+" ")
+}
+
+func evaluateBool(fname string, expr Expression, data JSONData) (result bool, err os.Error) {
+	value, err := expr.Evaluate(data)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s expects bools, but %v was %T %v", fname, expr, value, value)
+	}
+	return result, nil
+}
+
+/*
+ * If(condition bool, then, else) -> interface{}
+ *
+ * The value of then if the condition is true, or else if it's false. Only the chosen one is evaluated.
+ */
+type IfExpression struct {
+	condition Expression
+	then      Expression
+	otherwise Expression
+}
+
+func (i *IfExpression) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 3 {
+		return fmt.Errorf("If expects three arguments, a bool condition, the value if it's true and the value if it's false")
+	}
+	i.condition, i.then, i.otherwise = args[0], args[1], args[2]
+	return nil
+}
+
+func (i *IfExpression) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	condition, err := evaluateBool("If", i.condition, data)
+	if err != nil {
+		return nil, err
+	}
+	if condition {
+		return i.then.Evaluate(data)
+	}
+	return i.otherwise.Evaluate(data)
+}
+
+func (i *IfExpression) String() string {
+	return fmt.Sprintf("If(%v,%v,%v)", i.condition, i.then, i.otherwise)
+}
+
+// Operators inside other operators are wrapped in parens, so their String() reads the way they were parsed.
+func parenthesize(expr Expression) string {
+	switch expr.(type) {
+	case *ComparisonOperator, *BooleanOperator:
+		return fmt.Sprintf("(%v)", expr)
+	}
+	return expr.String()
+}
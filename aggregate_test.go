@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+)
+
+type comparisonTest struct {
+	fname    string
+	a, b     interface{}
+	expected interface{}
+	ok       bool
+}
+
+var comparisonTests = []comparisonTest{
+	// JSON numbers are float64s, literals may be ints
+	comparisonTest{"Eq", 200., 200, true, true},
+	comparisonTest{"Ne", 200., 200, false, true},
+	comparisonTest{"Lt", 199.5, 200, true, true},
+	comparisonTest{"Le", 200, 200., true, true},
+	comparisonTest{"Gt", 2, 10, false, true},
+	comparisonTest{"Ge", 10., 2, true, true},
+
+	// Strings are lexical
+	comparisonTest{"Eq", "home", "home", true, true},
+	comparisonTest{"Lt", "biz", "home", true, true},
+	comparisonTest{"Gt", "10", "9", false, true},
+	comparisonTest{"Ge", "home", "home", true, true},
+
+	// Bools are equal or not
+	comparisonTest{"Eq", true, true, true, true},
+	comparisonTest{"Ne", true, false, true, true},
+	comparisonTest{"Lt", false, true, nil, false},
+
+	// Missing values only equal each other
+	comparisonTest{"Eq", nil, nil, true, true},
+	comparisonTest{"Eq", nil, "home", false, true},
+	comparisonTest{"Ne", nil, 0, true, true},
+	comparisonTest{"Gt", nil, 500, false, true},
+	comparisonTest{"Le", 500., nil, false, true},
+
+	// Mismatched types can't be compared at all
+	comparisonTest{"Eq", "200", 200., nil, false},
+	comparisonTest{"Ne", "200", 200., nil, false},
+	comparisonTest{"Eq", "500", 500, nil, false},
+	comparisonTest{"Eq", true, 1, nil, false},
+	comparisonTest{"Gt", "home", 5, nil, false},
+	comparisonTest{"Le", 5., "home", nil, false},
+	comparisonTest{"Lt", true, 1, nil, false},
+
+	// Objects and arrays can't be compared at all
+	comparisonTest{"Eq", map[string]interface{}{"a": 1.}, map[string]interface{}{"a": 1.}, nil, false},
+	comparisonTest{"Ne", []interface{}{1.}, 1., nil, false},
+}
+
+func TestComparisons(t *testing.T) {
+	for _, test := range comparisonTests {
+		comparison := new(ComparisonOperator)
+		if err := comparison.Setup(test.fname, []Expression{&Literal{test.a}, &Literal{test.b}}); err != nil {
+			t.Fatalf("Couldn't set up %s: %v", test.fname, err)
+		}
+		result, err := comparison.Evaluate(nil)
+		if test.ok && err != nil {
+			t.Errorf("Expected %s(%v, %v) to evaluate, got %v", test.fname, test.a, test.b, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("Expected an error from %s(%v, %v), got %v", test.fname, test.a, test.b, result)
+		}
+		if result != test.expected {
+			t.Errorf("Expected %s(%v, %v) to be %v, got %v", test.fname, test.a, test.b, test.expected, result)
+		}
+	}
+}
+
+func TestComparisonFunctions(t *testing.T) {
+	for statement, expected := range map[string]string{
+		`Eq(servlet, "home")`:       "servlet == home",
+		"Lt(timing.total, 500)":     "timing.total < 500",
+		"Ge(Add(a, b), c)":          "Add(a,b) >= c",
+		`Ne(status == 200, cached)`: "(status == 200) != cached",
+	} {
+		expr, err := Parse(statement)
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %v", statement, err)
+		} else if expr.String() != expected {
+			t.Errorf("Expected %s to parse to %s, got %v", statement, expected, expr)
+		}
+	}
+
+	if _, err := Parse("Gt(a)"); err == nil {
+		t.Errorf("Expected Gt with one argument not to parse")
+	}
+}
+
+var booleanTests = []expressionTest{
+	expressionTest{`Or(servlet == "home", servlet == "biz")`, true, true},
+	expressionTest{`Or(servlet == "search", servlet == "biz", status >= 500)`, false, true},
+	expressionTest{`And(status == 200, servlet == "home", Not(cached))`, true, true},
+	expressionTest{`And(status == 200, cached)`, false, true},
+	expressionTest{"Not(cached)", true, true},
+	expressionTest{`If(cached, "hit", "miss")`, "miss", true},
+	expressionTest{`If(status == 200, timing.total, 0)`, 612.5, true},
+
+	// Operands after the deciding one aren't evaluated, even if they'd fail
+	expressionTest{"And(cached, servlet > 5)", false, true},
+	expressionTest{"Or(true, servlet > 5)", true, true},
+	expressionTest{"If(true, 1, servlet > 5)", 1, true},
+	expressionTest{"And(true, servlet > 5)", nil, false},
+
+	// Everything has to be a bool
+	expressionTest{"And(true, status)", nil, false},
+	expressionTest{"Or(false, servlet)", nil, false},
+	expressionTest{"Not(not_there)", nil, false},
+	expressionTest{"If(status, 1, 2)", nil, false},
+}
+
+func TestBooleanFunctions(t *testing.T) {
+	checkExpressions(t, `{"servlet": "home", "status": 200, "cached": false, "timing": {"total": 612.5}}`, booleanTests)
+
+	for _, statement := range []string{"And(a)", "Or()", "Not(a, b)", "If(a, b)"} {
+		if expr, err := Parse(statement); err == nil {
+			t.Errorf("Expected an error parsing %s, got %v", statement, expr)
+		}
+	}
+}
+
+func TestBooleanErrorsSayWhy(t *testing.T) {
+	expr, err := Parse("And(true, status)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = expr.Evaluate(map[string]interface{}{"status": 200.})
+	if err == nil || err.String() != "And expects bools, but status was float64 200" {
+		t.Errorf("Expected a clear error for a non-bool operand, got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"rand"
+)
+
+// Exponential backoff with jitter, so a room full of streams doesn't reconnect to a recovering
+// aggregator all at the same instant. All durations are in nanoseconds.
+type backoff struct {
+	min     int64
+	max     int64
+	current int64
+}
+
+func newBackoff(min int64, max int64) *backoff {
+	return &backoff{min: min, max: max}
+}
+
+// Returns how long to wait before the next attempt, somewhere between half and all of the current delay.
+func (b *backoff) Next() int64 {
+	if b.current == 0 {
+		b.current = b.min
+	} else {
+		b.current *= 2
+		if b.current > b.max {
+			b.current = b.max
+		}
+	}
+	return b.current/2 + rand.Int63n(b.current/2+1)
+}
+
+func (b *backoff) Reset() {
+	b.current = 0
+}
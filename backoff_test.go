@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBackoffGrowsAndResets(t *testing.T) {
+	retry := newBackoff(100, 1000)
+	for _, current := range []int64{100, 200, 400, 800, 1000, 1000} {
+		if delay := retry.Next(); delay < current/2 || delay > current {
+			t.Errorf("Expected a delay between %d and %d, but was %d", current/2, current, delay)
+		}
+	}
+
+	retry.Reset()
+	if delay := retry.Next(); delay < 50 || delay > 100 {
+		t.Errorf("Expected to start again from the minimum after a reset, but was %d", delay)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	cacheKeys       = flag.String("cache-key", "unique_request_id", "GetDeep path events are cached by for /lookup. Either one path for every log, or log=path pairs separated by commas, with an optional bare default")
+	cacheMaxEntries = flag.Int("cache-entries", 1024, "Most recent events cached per stream")
+	cacheMaxBytes   = flag.Int("cache-bytes", 16*1024*1024, "Most bytes of recent events cached per stream")
+)
+
+// Works out the cache key path for a log from the -cache-key flag, e.g. "request_id,ranger=unique_request_id".
+func cacheKeyFor(logName string) (keyPath string) {
+	return perLogSetting(*cacheKeys, logName)
+}
+
+// Picks a log's value out of a flag that's either one value for every log, or log=value pairs
+// separated by commas with an optional bare default.
+func perLogSetting(setting string, logName string) (value string) {
+	for _, entry := range strings.Split(setting, ",") {
+		entry = strings.TrimSpace(entry)
+		if equalsNdx := strings.Index(entry, "="); equalsNdx < 0 {
+			value = entry
+		} else if entry[:equalsNdx] == logName {
+			return entry[equalsNdx+1:]
+		}
+	}
+	return
+}
+
+// A cache of recent events, looked up by the value at keyPath. Bounded both by the number of events
+// and by their size (as it came off the wire), throwing out the oldest first.
+type eventCache struct {
+	keyPath    string
+	maxEntries int
+	maxBytes   int
+
+	lock    sync.Mutex
+	order   list.List // *cacheEntry, oldest at the front
+	entries map[string]*list.Element
+	bytes   int
+}
+
+type cacheEntry struct {
+	key  string
+	data JSONData
+	size int
+}
+
+func newEventCache(keyPath string, maxEntries int, maxBytes int) *eventCache {
+	c := new(eventCache)
+	c.keyPath = keyPath
+	c.maxEntries = maxEntries
+	c.maxBytes = maxBytes
+	c.entries = make(map[string]*list.Element, maxEntries)
+	c.order.Init()
+	return c
+}
+
+func (c *eventCache) Add(data JSONData, size int) {
+	if c.keyPath == "" || c.maxEntries <= 0 || size > c.maxBytes {
+		return
+	}
+
+	value, ok := GetDeep(c.keyPath, data)
+	if !ok || value == nil {
+		// No key for us
+		return
+	}
+	key := fmt.Sprint(value)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushBack(&cacheEntry{key, data, size})
+	c.bytes += size
+
+	for c.order.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.order.Front())
+	}
+}
+
+func (c *eventCache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.order.Remove(element)
+	c.entries[entry.key] = nil, false
+	c.bytes -= entry.size
+}
+
+func (c *eventCache) Lookup(key string) (data JSONData, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(*cacheEntry).data, true
+}
+
+func (c *eventCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.order.Len()
+}
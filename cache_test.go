@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func cacheEvent(id string) JSONData {
+	return map[string]interface{}{"request": map[string]interface{}{"id": id}}
+}
+
+func TestEventCacheBounds(t *testing.T) {
+	cache := newEventCache("request.id", 3, 100)
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		cache.Add(cacheEvent(id), 10)
+	}
+	if _, ok := cache.Lookup("a"); ok {
+		t.Errorf("Expected the oldest entry to be evicted by count")
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		if _, ok := cache.Lookup(id); !ok {
+			t.Errorf("Expected to find %s", id)
+		}
+	}
+
+	// Big enough to push out everything else
+	cache.Add(cacheEvent("big"), 95)
+	if cache.Len() != 1 {
+		t.Errorf("Expected the cache to be evicted by size down to 1 entry, but was %d", cache.Len())
+	}
+	if cache.bytes != 95 {
+		t.Errorf("Expected 95 bytes cached, but was %d", cache.bytes)
+	}
+
+	// Too big to cache at all
+	cache.Add(cacheEvent("huge"), 101)
+	if _, ok := cache.Lookup("huge"); ok {
+		t.Errorf("Expected an entry bigger than the cache to be skipped")
+	}
+
+	// Events without a key are ignored
+	cache.Add(map[string]interface{}{"other": 1.}, 1)
+	if cache.Len() != 1 {
+		t.Errorf("Expected an event without a key to be skipped, but had %d entries", cache.Len())
+	}
+}
+
+func TestEventCacheReplace(t *testing.T) {
+	cache := newEventCache("request.id", 3, 100)
+	cache.Add(cacheEvent("a"), 10)
+	cache.Add(cacheEvent("a"), 20)
+
+	if cache.Len() != 1 || len(cache.entries) != 1 || cache.bytes != 20 {
+		t.Errorf("Expected a replaced key to be counted once, got %d entries, %d keys and %d bytes", cache.Len(), len(cache.entries), cache.bytes)
+	}
+}
+
+type cacheKeyForTest struct {
+	flag    string
+	logName string
+	keyPath string
+}
+
+var cacheKeyForTests = []cacheKeyForTest{
+	cacheKeyForTest{"unique_request_id", "ranger", "unique_request_id"},
+	cacheKeyForTest{"request_id,ranger=unique_request_id", "ranger", "unique_request_id"},
+	cacheKeyForTest{"request_id, ranger=unique_request_id", "access", "request_id"},
+	cacheKeyForTest{"ranger=unique_request_id", "access", ""},
+}
+
+func TestCacheKeyFor(t *testing.T) {
+	defer func(original string) { *cacheKeys = original }(*cacheKeys)
+
+	for _, test := range cacheKeyForTests {
+		*cacheKeys = test.flag
+		if keyPath := cacheKeyFor(test.logName); keyPath != test.keyPath {
+			t.Errorf("For -cache-key '%s' and log %s, expected '%s', but was '%s'", test.flag, test.logName, test.keyPath, keyPath)
+		}
+	}
+}
@@ -1,199 +1,655 @@
 package main
 
 import (
-	"net"
 	"bufio"
-	"container/list"
+	"flag"
+	"fmt"
 	"io"
 	"json"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 type SubscribeRequest struct {
-	dataChan chan JSONData
-	id       int
+	dataChan   chan JSONData
+	statusChan chan *StreamStatus
+	id         int
+
+	// What to do when dataChan is full
+	policy       string
+	blockTimeout int64 // Nanoseconds, for the Block policy
+
+	origin string // If set, injected into each event as originField, so merged streams can be told apart
+
+	// If backfill is set, we send the stream's history going back that many nanoseconds to backlogChan on subscribing.
+	backfill    int64
+	backlogChan chan []HistoryEvent
+
+	dropLock sync.Mutex
+	dropped  int64 // Events dropped since the last TakeDropped()
+
+	unsubscribed chan bool // Closed by Unsubscribe, so nothing waits on a subscriber that's gone
+}
+
+// Backpressure policies, for subscribers that can't keep up with the stream.
+const (
+	DropNewest = "drop-newest" // Throw away the event we're trying to deliver
+	DropOldest = "drop-oldest" // Throw away the oldest buffered event to make room, so the subscriber sees the latest data
+	Block      = "block"       // Hold up the whole stream for up to blockTimeout, then drop
+)
+
+const defaultBlockTimeout = 100e6
+
+func NewSubscribeRequest(bufferSize int, policy string, blockTimeout int64) (request *SubscribeRequest, err os.Error) {
+	switch policy {
+	case "":
+		policy = DropNewest
+	case DropNewest, DropOldest, Block:
+	default:
+		return nil, fmt.Errorf("Unknown backpressure policy '%s', expected one of %s, %s or %s", policy, DropNewest, DropOldest, Block)
+	}
+	if blockTimeout <= 0 {
+		blockTimeout = defaultBlockTimeout
+	}
+
+	request = new(SubscribeRequest)
+	request.dataChan = make(chan JSONData, bufferSize)
+	request.statusChan = make(chan *StreamStatus, 4)
+	request.policy = policy
+	request.blockTimeout = blockTimeout
+	return request, nil
+}
+
+// Returns a new request that delivers into the same channels, with the same policy.
+// Subscribing siblings to several streams merges them.
+func (request *SubscribeRequest) Sibling(origin string) *SubscribeRequest {
+	sibling := new(SubscribeRequest)
+	sibling.dataChan = request.dataChan
+	sibling.statusChan = request.statusChan
+	sibling.policy = request.policy
+	sibling.blockTimeout = request.blockTimeout
+	sibling.origin = origin
+	sibling.backfill = request.backfill
+	sibling.backlogChan = request.backlogChan
+	return sibling
+}
+
+// Ask for the last backfill nanoseconds of history on subscribing, from each of the given number of streams.
+func (request *SubscribeRequest) SetBackfill(backfill int64, streams int) {
+	request.backfill = backfill
+	request.backlogChan = make(chan []HistoryEvent, streams)
+}
+
+const originField = "_origin"
+
+// Events are shared between subscribers, so we tag a shallow copy rather than the event itself.
+func withOrigin(data JSONData, origin string) JSONData {
+	event, ok := data.(map[string]interface{})
+	if !ok {
+		return data
+	}
+	tagged := make(map[string]interface{}, len(event)+1)
+	for key, value := range event {
+		tagged[key] = value
+	}
+	tagged[originField] = origin
+	return tagged
+}
+
+// Hands data to the subscriber, applying its backpressure policy if it's falling behind.
+func (request *SubscribeRequest) deliver(data JSONData) {
+	if request.origin != "" {
+		data = withOrigin(data, request.origin)
+	}
+
+	select {
+	case request.dataChan <- data:
+		return
+	default:
+	}
+
+	switch request.policy {
+	case DropOldest:
+		if cap(request.dataChan) == 0 {
+			break
+		}
+		for {
+			select {
+			case <-request.dataChan:
+				request.addDropped(1)
+			default:
+			}
+			select {
+			case request.dataChan <- data:
+				return
+			default:
+			}
+		}
+	case Block:
+		select {
+		case request.dataChan <- data:
+			return
+		case <-time.After(request.blockTimeout):
+		}
+	}
+	request.addDropped(1)
+}
+
+func (request *SubscribeRequest) addDropped(count int64) {
+	request.dropLock.Lock()
+	request.dropped += count
+	request.dropLock.Unlock()
+}
+
+// Returns how many events were dropped since the last call.
+func (request *SubscribeRequest) TakeDropped() (dropped int64) {
+	request.dropLock.Lock()
+	dropped, request.dropped = request.dropped, 0
+	request.dropLock.Unlock()
+	return
+}
+
+// Connection states reported to subscribers as the stream comes and goes.
+const (
+	StatusConnecting = "connecting"
+	StatusConnected  = "connected"
+	StatusDegraded   = "degraded"
+	StatusFinished   = "finished"
+)
+
+type StreamStatus struct {
+	Stream  string
+	Source  string
+	State   string
+	Message string
 }
 
+// Status updates are sent to clients in-band, as an object rather than the usual array of field pairs.
+func (status *StreamStatus) ControlFrame() JSONData {
+	return map[string]interface{}{
+		"control": "status",
+		"stream":  status.Stream,
+		"source":  status.Source,
+		"state":   status.State,
+		"message": status.Message,
+	}
+}
+
+var maxLineSize = flag.Int("max-line", 1024*1024, "Longest upstream line, in bytes, that we reassemble rather than skip")
+
+// Bounds on how long we wait between attempts to reach the upstream, in nanoseconds.
+const (
+	minReconnectDelay = 250e6
+	maxReconnectDelay = 30e9
+)
+
 type DataStream struct {
-	name          string
-	connectString string
+	name    string
+	source  Source
+	decoder Decoder // Only used by the goroutine in run()
 
 	// We support keeping a cache of recent data items for later inspection. Obviously we want to cap the size on this.
-	dataCacheKey     string
-	dataCacheIndexes list.List
-	dataCache        map[string]*JSONData
+	cache *eventCache
 
-	rawStream io.ReadWriteCloser // Raw io stream of data
-	ioStream  *bufio.Reader      // Our buffered view of our data stream
+	// Recent events in the order they arrived, to backfill new subscribers. Only kept once someone asks for a backfill.
+	history *eventHistory
 
-	subscribeChan   chan *SubscribeRequest
-	unsubscribeChan chan *SubscribeRequest
+	maxLineSize int // Lines longer than this are skipped rather than reassembled
 
-	allChannels [](chan JSONData)
+	health      *streamHealth
+	idleTimeout int64 // Reconnect after this many nanoseconds of silence from a live source
+
+	maxRate float64  // Events per second we pass on before shedding load, zero if unlimited
+	sampler *sampler // Only used by the goroutine in run()
+
+	// Subscribers come and go from their own goroutines while run() reads the upstream in another,
+	// so everything below is only touched holding lock.
+	lock sync.Mutex
+
+	// Never modified in place, only replaced, so run() can deliver to the slice it saw without holding the lock.
+	subscribers []*SubscribeRequest
+	nextID      int
+
+	recorder *Recorder // If set, every decoded line is also written to disk. Keeps the stream open without subscribers.
+
+	running  bool          // Whether we have a goroutine connecting to or reading from the upstream
+	upstream io.Closer     // What run() is reading right now, so we can hang up once nobody wants it
+	hungUp   bool          // Whether we closed upstream out from under run() on purpose
+	status   *StreamStatus // The last status we sent, so new subscribers know where we stand
 }
 
-func NewDataStream(name string, connectString string) (stream *DataStream) {
+func NewDataStream(name string, source Source, decoder Decoder) (stream *DataStream) {
 	stream = new(DataStream)
 	stream.name = name
-	stream.connectString = connectString
-
-	// TODO: Make this dynamic
-	stream.dataCacheKey = "unique_request_id"
-	stream.subscribeChan = make(chan *SubscribeRequest)
-	stream.unsubscribeChan = make(chan *SubscribeRequest)
-	stream.allChannels = make([](chan JSONData), 0, 64)
+	stream.source = source
+	stream.decoder = decoder
+
+	stream.cache = newEventCache(cacheKeyFor(name), *cacheMaxEntries, *cacheMaxBytes)
+	stream.history = newEventHistory(historyMaxAge(), *historyMaxEvents, *historyMaxBytes)
+	stream.status = &StreamStatus{name, source.String(), StatusConnecting, ""}
+	stream.maxLineSize = *maxLineSize
+	stream.health = new(streamHealth)
+	stream.idleTimeout = idleTimeoutNs()
+	stream.maxRate = maxRateFor(name)
+	if stream.maxRate > 0 {
+		stream.sampler = newSampler(stream.maxRate)
+	}
+	return
+}
 
-	stream.dataCache = make(map[string]*JSONData, 64)
+// Starts delivering events to the request, connecting to the upstream if we aren't already.
+func (stream *DataStream) Subscribe(request *SubscribeRequest) {
+	stream.lock.Lock()
+	request.id = stream.nextID
+	stream.nextID++
+	if request.unsubscribed == nil {
+		request.unsubscribed = make(chan bool)
+	}
+	subscribers := make([]*SubscribeRequest, len(stream.subscribers), len(stream.subscribers)+1)
+	copy(subscribers, stream.subscribers)
+	stream.subscribers = append(subscribers, request)
+	log.Printf("Adding new channel %d to data stream %s", request.id, stream.name)
+
+	// Events are added to the history under the same lock, so the backlog ends exactly where live events begin.
+	// Only the snapshot is taken here though, the rest can wait until we've let go of the stream.
+	var history []HistoryEvent
+	if request.backlogChan != nil {
+		stream.history.Enable()
+		history = stream.history.Since(time.Nanoseconds() - request.backfill)
+	}
 
-	stream.dataCacheIndexes.Init()
+	// If we are not yet streaming data, we should be
+	if !stream.running {
+		stream.start()
+	} else {
+		request.sendStatus(stream.status)
+	}
+	stream.lock.Unlock()
 
-	go stream.acceptChannels()
-	return
+	// backlogChan has room for one backlog per stream, so this won't block.
+	if request.backlogChan != nil {
+		request.backlogChan <- stream.backlog(request, history)
+	}
 }
 
-func (stream *DataStream) acceptChannels() {
-	for {
+func (stream *DataStream) backlog(request *SubscribeRequest, events []HistoryEvent) []HistoryEvent {
+	if request.origin != "" {
+		for ndx, event := range events {
+			events[ndx].Data = withOrigin(event.Data, request.origin)
+		}
+	}
+	log.Printf("Backfilling channel %d with %d events from %s", request.id, len(events), stream.name)
+	return events
+}
 
-		select {
-		case channelRequest := <-stream.subscribeChan:
-			stream.subscribe(channelRequest)
-		case channelRequest := <-stream.unsubscribeChan:
-			stream.unsubscribe(channelRequest)
+// Stops delivering events to the request. If nobody else wants the stream, we hang up on the upstream.
+func (stream *DataStream) Unsubscribe(request *SubscribeRequest) {
+	stream.lock.Lock()
+	subscribers := make([]*SubscribeRequest, 0, len(stream.subscribers))
+	for _, subscriber := range stream.subscribers {
+		if subscriber != request {
+			subscribers = append(subscribers, subscriber)
 		}
 	}
+	if len(subscribers) < len(stream.subscribers) {
+		close(request.unsubscribed)
+	}
+	stream.subscribers = subscribers
+	log.Println("Dropping channel", request.id)
+	upstream := stream.hangUpIfUnwanted()
+	stream.lock.Unlock()
+
+	if upstream != nil {
+		upstream.Close()
+	}
 }
 
-func (stream *DataStream) subscribe(request *SubscribeRequest) {
-	request.id = -1
-	for ndx, value := range stream.allChannels {
-		if value == nil {
-			stream.allChannels[ndx] = request.dataChan
-			request.id = ndx
-			break
+// Start recording to the given Recorder, replacing any current one. A nil Recorder stops recording.
+func (stream *DataStream) Record(recorder *Recorder) {
+	stream.lock.Lock()
+	previous := stream.recorder
+	stream.recorder = recorder
+	if recorder != nil {
+		log.Printf("Starting %v", recorder)
+		stream.start()
+	}
+	upstream := stream.hangUpIfUnwanted()
+	stream.lock.Unlock()
+
+	if previous != nil {
+		log.Printf("Stopping %v", previous)
+		if err := previous.Close(); err != nil {
+			log.Printf("Failed to close %v: %v", previous, err)
 		}
 	}
-	if request.id < 0 {
-		stream.allChannels = append(stream.allChannels, request.dataChan)
-		request.id = (len(stream.allChannels) - 1)
+	if upstream != nil {
+		upstream.Close()
 	}
-	log.Printf("Adding new channel %d to data stream", request.id, stream.name)
+}
 
-	// If we are not yet streaming data, we should be
-	if stream.ioStream == nil {
-		stream.createIOStream()
-		go stream.streamData()
+// A stream is wanted as long as someone is subscribed or we are recording it. Call holding lock.
+func (stream *DataStream) wanted() bool {
+	return len(stream.subscribers) > 0 || stream.recorder != nil
+}
+
+// Call holding lock.
+func (stream *DataStream) start() {
+	if !stream.running {
+		stream.running = true
+		go stream.run()
 	}
 }
 
-func (stream *DataStream) unsubscribe(request *SubscribeRequest) {
-	log.Println("Dropping channel", request.id)
-	stream.allChannels[request.id] = nil
+// Returns the upstream for the caller to close, once it has let go of the lock, if nobody wants it any more.
+// Call holding lock.
+func (stream *DataStream) hangUpIfUnwanted() (upstream io.Closer) {
+	if stream.wanted() || stream.upstream == nil {
+		return nil
+	}
+	log.Printf("Closing data stream for %s", stream.name)
+	upstream = stream.upstream
+	stream.upstream, stream.hungUp = nil, true
+	return upstream
 }
 
-func (stream *DataStream) cacheData(data *JSONData) {
-	dataKey, ok := GetDeep(stream.dataCacheKey, *data)
-	if !ok {
-		log.Printf("Failed to find key %s", stream.dataCacheKey)
+func (stream *DataStream) Recording() bool {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	return stream.recorder != nil
+}
+
+// Whether we have a goroutine connecting to or reading from the upstream
+func (stream *DataStream) Running() bool {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	return stream.running
+}
+
+func (stream *DataStream) Status() *StreamStatus {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	return stream.status
+}
+
+func (stream *DataStream) setStatus(state string, message string) {
+	log.Printf("Data stream %s is %s: %s", stream.name, state, message)
+	status := &StreamStatus{stream.name, stream.source.String(), state, message}
+
+	stream.lock.Lock()
+	stream.status = status
+	subscribers := stream.subscribers
+	stream.lock.Unlock()
+
+	for _, request := range subscribers {
+		if state == StatusFinished {
+			request.sendLastStatus(status)
+		} else {
+			request.sendStatus(status)
+		}
+	}
+}
+
+func (request *SubscribeRequest) sendStatus(status *StreamStatus) {
+	if request.statusChan == nil {
 		return
 	}
+	// Status updates aren't worth blocking the stream over.
+	select {
+	case request.statusChan <- status:
+	default:
+		log.Println("Dropping status to channel", request.id)
+	}
+}
 
-	dataKeyStr, ok := dataKey.(string)
-	if !ok {
-		// No key for us
+// Nothing comes after a stream finishing, and subscribers may be waiting for it, so that status is never dropped.
+// We wait for room, unless the subscriber leaves first.
+func (request *SubscribeRequest) sendLastStatus(status *StreamStatus) {
+	if request.statusChan == nil {
 		return
-	
 	}
+	select {
+	case request.statusChan <- status:
+	case <-request.unsubscribed:
+	}
+}
 
+// Finds a recent event by the value at the cache's key path, e.g. a unique_request_id.
+func (stream *DataStream) LookupData(key string) (data JSONData, ok bool) {
+	return stream.cache.Lookup(key)
+}
 
-	stream.dataCache[dataKeyStr] = data
-	stream.dataCacheIndexes.PushBack(dataKeyStr)
+// Called by run() before each connection attempt. If nobody wants the stream any more it stops running, in the
+// same breath, so a subscriber arriving just as we wind down starts a fresh run() rather than being left waiting.
+func (stream *DataStream) keepRunning() bool {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
 
-	if stream.dataCacheIndexes.Len() >= 64 {
-		front := stream.dataCacheIndexes.Front()
-		stream.dataCache[front.Value.(string)] = nil
-		stream.dataCacheIndexes.Remove(front)
+	if stream.wanted() {
+		return true
 	}
+	stream.running = false
+	return false
 }
 
-func (stream *DataStream) LookupData(key string) *JSONData {
-	data, ok := stream.dataCache[key]
-	if !ok {
-		return nil
+// Stops running regardless of who wants the stream, e.g. because the source has run out.
+func (stream *DataStream) stop() {
+	stream.lock.Lock()
+	stream.running = false
+	stream.lock.Unlock()
+}
+
+// Lets Unsubscribe and Record hang up on the new connection. Returns false if nobody wants it already.
+func (stream *DataStream) connected(rawStream io.Closer) bool {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	if !stream.wanted() {
+		return false
 	}
+	stream.upstream, stream.hungUp = rawStream, false
+	return true
+}
+
+// Returns whether the connection was closed because nobody wanted it, rather than failing.
+func (stream *DataStream) disconnected() (hungUp bool) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
 
-	return data
+	hungUp = stream.hungUp
+	stream.upstream, stream.hungUp = nil, false
+	return
 }
 
-func (stream *DataStream) streamData() {
-	for {
-		line, isPrefix, err := stream.ioStream.ReadLine()
+// Keeps the stream connected for as long as anyone is subscribed, backing off between failed attempts.
+func (stream *DataStream) run() {
+	retry := newBackoff(minReconnectDelay, maxReconnectDelay)
+	for stream.keepRunning() {
+		stream.setStatus(StatusConnecting, stream.source.String())
+		rawStream, ioStream, err := stream.open()
 		if err != nil {
-			if err == os.EOF {
-				break
-			}
-			log.Printf("Failed on line stream", err)
+			delay := retry.Next()
+			stream.setStatus(StatusDegraded, fmt.Sprintf("Failed to open %v: %v. Retrying in %.1fs", stream.source, err, float64(delay)/1e9))
+			time.Sleep(delay)
+			continue
+		}
+		if !stream.connected(rawStream) {
+			rawStream.Close()
+			continue
+		}
+		stream.setStatus(StatusConnected, stream.source.String())
+		stream.decoder.Reset()
+		stream.health.Connected(true)
+
+		done, idled := make(chan bool), make(chan bool, 1)
+		if stream.idleTimeout > 0 && isLive(stream.source) {
+			go stream.watchIdle(rawStream, stream.idleTimeout, done, idled)
+		}
+
+		received, err := stream.streamData(ioStream)
+		close(done)
+		stream.health.Connected(false)
+		if !stream.disconnected() {
+			rawStream.Close()
+		} else {
+			// Whatever went wrong reading, it was us hanging up. See if anyone turned up in the meantime.
+			continue
+		}
+		select {
+		case <-idled:
+			err = fmt.Errorf("nothing received for %.0fs", float64(stream.idleTimeout)/1e9)
+		default:
+		}
+		if err == nil {
+			continue
+		}
+		if err == os.EOF && isFinite(stream.source) {
+			stream.setStatus(StatusFinished, fmt.Sprintf("Reached the end of %v", stream.source))
+			stream.stop()
 			break
 		}
-		if isPrefix {
-			log.Printf("PREFIX!! Skipping line.")
+
+		// Only start backing off from scratch if the last connection was actually good for something.
+		if received > 0 {
+			retry.Reset()
+		}
+		delay := retry.Next()
+		stream.setStatus(StatusDegraded, fmt.Sprintf("Lost %v: %v. Reconnecting in %.1fs", stream.source, err, float64(delay)/1e9))
+		time.Sleep(delay)
+	}
+	log.Printf("All done with data stream %s", stream.name)
+}
+
+// Reads from the upstream until it fails, or until nobody is listening any more (in which case err is nil).
+func (stream *DataStream) streamData(ioStream *bufio.Reader) (received int, err os.Error) {
+	for {
+		line, oversize, err := stream.readLine(ioStream)
+		if err != nil {
+			return received, err
+		}
+		received++
+		if oversize {
+			skipped := stream.health.OversizeLine()
+			log.Printf("Skipping line longer than %d bytes on %s (%d so far)", stream.maxLineSize, stream.name, skipped)
 			continue
 		}
+		stream.health.Event(len(line), time.Nanoseconds())
 
 		// We have fairly reliable looking chunk of data, try to decode it
-		var data JSONData
-		err = json.Unmarshal(line, &data)
+		data, err := stream.decoder.Decode(line)
 		if err != nil {
+			stream.health.DecodeFailure()
 			log.Printf("Failure to decode: %s", err)
 			log.Println(string(line))
 			log.Println()
 			continue
 		}
+		if data == nil {
+			continue
+		}
+
+		// Shed load before anything else has to deal with the event
+		if stream.sampler != nil {
+			keep, weight := stream.sampler.Sample(time.Nanoseconds())
+			stream.health.Sampled(keep, stream.sampler.Fraction())
+			if !keep {
+				continue
+			}
+			data = withWeight(data, weight)
+		}
 
 		// Add to our cache
-		// Currently disabled due to memory leaks
-		//stream.cacheData(&data)
+		stream.cache.Add(data, len(line))
+
+		// A new subscriber either gets this event in its backlog or gets it delivered, never both or neither.
+		stream.lock.Lock()
+		stream.history.Add(data, len(line))
+		subscribers, recorder := stream.subscribers, stream.recorder
+		stream.lock.Unlock()
+
+		if recorder != nil {
+			stream.record(recorder, line, data)
+		}
 
 		// Now deliver this fine chunk of ranger data to each of our listeners
-		sent := false
-		for ndx, dataChannel := range stream.allChannels {
-			if dataChannel != nil {
-				// We don't want to be blocking waiting on the channel, if it can't keep up we'll drop the data.
-				select {
-				case dataChannel <- data:
-				default:
-					log.Println("Dropping data to channel", ndx)
-				}
-				sent = true
-			}
+		for _, request := range subscribers {
+			request.deliver(data)
 		}
 		/* There are no dataChannel's left open, we can close the stream */
-		if !sent {
-			log.Printf("Closing data stream for %s", stream.name)
-			stream.rawStream.Close()
-			stream.rawStream = nil
-			stream.ioStream = nil
-			break
+		if len(subscribers) == 0 && recorder == nil {
+			return received, nil
 		}
 	}
-	log.Printf("All done with data stream %s", stream.name)
+	return
 }
 
+// Recordings are always JSONL, so lines in other formats are recorded as we decoded them.
+func (stream *DataStream) record(recorder *Recorder, line []byte, data JSONData) {
+	var err os.Error
+	if _, isJSON := stream.decoder.(*jsonDecoder); !isJSON {
+		line, err = json.Marshal(data)
+		if err != nil {
+			log.Printf("Failed to encode %s for recording: %v", stream.name, err)
+			return
+		}
+	}
+	if err = recorder.Record(line); err != nil {
+		log.Printf("Failed to record %s: %v", stream.name, err)
+	}
+}
 
-func (stream *DataStream) createIOStream() {
-	conn, err := net.Dial("tcp4", stream.connectString)
+// Reads a whole line, reassembling it from pieces if it's longer than our read buffer.
+// Lines over maxLineSize are consumed up to the next newline and reported as oversize, so we stay in sync.
+func (stream *DataStream) readLine(ioStream *bufio.Reader) (line []byte, oversize bool, err os.Error) {
+	fragment, isPrefix, err := ioStream.ReadLine()
 	if err != nil {
-		log.Fatal("Failed to open", err)
+		return nil, false, err
 	}
+	if len(fragment) > stream.maxLineSize {
+		oversize = true
+	} else if !isPrefix {
+		return fragment, false, nil
+	} else {
+		// ReadLine hands back its own buffer, which the next call overwrites.
+		line = append([]byte{}, fragment...)
+	}
+
+	for isPrefix {
+		fragment, isPrefix, err = ioStream.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		if oversize {
+			continue
+		}
+		if len(line)+len(fragment) > stream.maxLineSize {
+			oversize = true
+			line = nil
+		} else {
+			line = append(line, fragment...)
+		}
+	}
+	if oversize {
+		return nil, true, nil
+	}
+	return line, false, nil
+}
 
-	_, err = conn.Write([]uint8(stream.name + "\n"))
+// Each connection gets its own reader, so a run() winding down never shares one with its replacement.
+func (stream *DataStream) open() (rawStream io.ReadCloser, ioStream *bufio.Reader, err os.Error) {
+	rawStream, err = stream.source.Open(stream.name)
 	if err != nil {
-		log.Fatal("Failed to send cmd", err)
+		return nil, nil, err
 	}
 
-	stream.rawStream = conn
-	stream.ioStream, err = bufio.NewReaderSize(conn, 1024*32)
+	ioStream, err = bufio.NewReaderSize(rawStream, 1024*32)
 	if err != nil {
-		log.Fatal("Failed to create reader", err)
+		rawStream.Close()
+		return nil, nil, err
 	}
+	return rawStream, ioStream, nil
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type readLineTest struct {
+	line     string
+	oversize bool
+}
+
+func TestReadLineReassembly(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	tooLong := strings.Repeat("y", 300)
+	tests := []readLineTest{
+		readLineTest{"short", false},
+		readLineTest{long, false},
+		readLineTest{"", true},
+		readLineTest{"after", false},
+		readLineTest{"", true},
+		readLineTest{"end", false},
+	}
+	input := "short\n" + long + "\n" + tooLong + "\nafter\n" + strings.Repeat("z", 200) + "\nend\n"
+
+	stream := new(DataStream)
+	stream.maxLineSize = 128
+	ioStream, _ := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	for ndx, test := range tests {
+		line, oversize, err := stream.readLine(ioStream)
+		if err != nil {
+			t.Fatalf("Line %d: unexpected err %v", ndx, err)
+		}
+		if oversize != test.oversize {
+			t.Errorf("Line %d: expected oversize = %t, but was %t", ndx, test.oversize, oversize)
+		}
+		if string(line) != test.line {
+			t.Errorf("Line %d: expected '%s', but was '%s'", ndx, test.line, line)
+		}
+	}
+
+	if _, _, err := stream.readLine(ioStream); err != os.EOF {
+		t.Errorf("Expected EOF at the end, but was %v", err)
+	}
+}
+
+type deliverTest struct {
+	policy   string
+	received []float64
+	dropped  int64
+}
+
+var deliverTests = []deliverTest{
+	deliverTest{DropNewest, []float64{1, 2}, 2},
+	deliverTest{DropOldest, []float64{3, 4}, 2},
+	deliverTest{Block, []float64{1, 2}, 2},
+}
+
+func TestDeliverPolicies(t *testing.T) {
+	for _, test := range deliverTests {
+		request, err := NewSubscribeRequest(2, test.policy, 1e6)
+		if err != nil {
+			t.Fatalf("Couldn't create request for %s: %v", test.policy, err)
+		}
+		for _, value := range []float64{1, 2, 3, 4} {
+			request.deliver(value)
+		}
+
+		for _, expected := range test.received {
+			if value := <-request.dataChan; value != expected {
+				t.Errorf("With %s, expected %v, but got %v", test.policy, expected, value)
+			}
+		}
+		if dropped := request.TakeDropped(); dropped != test.dropped {
+			t.Errorf("With %s, expected %d dropped, but was %d", test.policy, test.dropped, dropped)
+		}
+		if dropped := request.TakeDropped(); dropped != 0 {
+			t.Errorf("With %s, expected the drop count to reset, but was %d", test.policy, dropped)
+		}
+	}
+
+	if _, err := NewSubscribeRequest(2, "drop-everything", 0); err == nil {
+		t.Errorf("Expected an unknown policy to be rejected")
+	}
+}
+
+// A source that never runs dry, until it's closed
+type endlessSource struct {
+	lock  sync.Mutex
+	opens int
+}
+
+func (s *endlessSource) Open(logName string) (io.ReadCloser, os.Error) {
+	s.lock.Lock()
+	s.opens++
+	s.lock.Unlock()
+
+	reader, writer := io.Pipe()
+	go func() {
+		for {
+			if _, err := writer.Write([]byte(`{"servlet": "home"}` + "\n")); err != nil {
+				return
+			}
+			time.Sleep(1e5)
+		}
+	}()
+	return reader, nil
+}
+
+func (s *endlessSource) String() string {
+	return "endless://"
+}
+
+func receiveOne(t *testing.T, request *SubscribeRequest) {
+	select {
+	case <-request.dataChan:
+	case <-time.After(5e9):
+		t.Errorf("Timed out waiting for data on channel %d", request.id)
+	}
+}
+
+func waitForStop(t *testing.T, stream *DataStream) {
+	deadline := time.Nanoseconds() + 5e9
+	for stream.Running() {
+		if time.Nanoseconds() > deadline {
+			t.Fatalf("Stream still running with nobody subscribed")
+		}
+		time.Sleep(1e6)
+	}
+}
+
+func TestManyShortLivedSubscribers(t *testing.T) {
+	const clients, rounds = 50, 20
+	source := new(endlessSource)
+	stream := NewDataStream("ranger", source, new(jsonDecoder))
+
+	done := make(chan bool)
+	for i := 0; i < clients; i++ {
+		go func() {
+			for j := 0; j < rounds; j++ {
+				request, _ := NewSubscribeRequest(4, DropNewest, 0)
+				stream.Subscribe(request)
+				receiveOne(t, request)
+				stream.Unsubscribe(request)
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < clients; i++ {
+		<-done
+	}
+
+	// Once everyone's gone the stream winds down, and starts up cleanly for the next subscriber
+	waitForStop(t, stream)
+	request, _ := NewSubscribeRequest(4, DropNewest, 0)
+	stream.Subscribe(request)
+	receiveOne(t, request)
+	stream.Unsubscribe(request)
+	waitForStop(t, stream)
+}
+
+func TestResubscribeWhileClosing(t *testing.T) {
+	source := new(endlessSource)
+	stream := NewDataStream("ranger", source, new(jsonDecoder))
+
+	for i := 0; i < 100; i++ {
+		request, _ := NewSubscribeRequest(4, DropNewest, 0)
+		stream.Subscribe(request)
+		receiveOne(t, request)
+		// The stream is hanging up on the upstream as the next one arrives
+		stream.Unsubscribe(request)
+	}
+	waitForStop(t, stream)
+
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if source.opens < 2 {
+		t.Errorf("Expected the stream to reconnect after being closed, but it was opened %d times", source.opens)
+	}
+}
+
+// A source that can't be reached the first few times. After that each connection sends one event, saying which
+// connection it was, and then fails.
+type flakySource struct {
+	lock     sync.Mutex
+	failures int
+	opens    int
+}
+
+func (s *flakySource) Open(logName string) (io.ReadCloser, os.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.opens++
+	if s.opens <= s.failures {
+		return nil, os.NewError("connection refused")
+	}
+	reader, writer := io.Pipe()
+	go func(connection int) {
+		writer.Write([]byte(fmt.Sprintf(`{"connection": %d}`+"\n", connection)))
+		writer.CloseWithError(os.NewError("connection reset"))
+	}(s.opens)
+	return reader, nil
+}
+
+func (s *flakySource) String() string {
+	return "flaky://"
+}
+
+func TestReconnectsAfterFailures(t *testing.T) {
+	stream := NewDataStream("ranger", &flakySource{failures: 2}, new(jsonDecoder))
+	request, _ := NewSubscribeRequest(16, DropNewest, 0)
+	request.statusChan = make(chan *StreamStatus, 64)
+	stream.Subscribe(request)
+	defer stream.Unsubscribe(request)
+
+	// Two failed attempts, then a connection that's lost after one event and the one after it
+	for _, connection := range []float64{3, 4} {
+		select {
+		case data := <-request.dataChan:
+			if value, _ := GetDeep("connection", data); value != connection {
+				t.Errorf("Expected an event from connection %v, but got %v", connection, data)
+			}
+		case <-time.After(5e9):
+			t.Fatalf("Timed out waiting for connection %v", connection)
+		}
+	}
+
+	states := []string{StatusConnecting, StatusDegraded, StatusConnecting, StatusDegraded, StatusConnecting, StatusConnected, StatusDegraded, StatusConnecting, StatusConnected}
+	for ndx, state := range states {
+		status := <-request.statusChan
+		if status.State != state {
+			t.Fatalf("Status %d: expected %s, but was %s (%s)", ndx, state, status.State, status.Message)
+		}
+		// Having been connected, we start backing off from the minimum again rather than carrying on from 0.5s
+		if ndx == 6 {
+			var delay float64
+			message := status.Message
+			_, err := fmt.Sscanf(message[strings.LastIndex(message, " in ")+4:], "%fs", &delay)
+			if err != nil || delay > float64(minReconnectDelay)/1e9 {
+				t.Errorf("Expected to reconnect within %.2fs, but was told \"%s\"", float64(minReconnectDelay)/1e9, message)
+			}
+		}
+	}
+}
+
+func TestSiblingsMergeStreams(t *testing.T) {
+	stageFile := writeFixture(t, `{"servlet": "home"}`+"\n"+`{"servlet": "biz"}`+"\n")
+	defer os.Remove(stageFile)
+	prodFile := writeFixture(t, `{"servlet": "search"}`+"\n"+`{"servlet": "user"}`+"\n")
+	defer os.Remove(prodFile)
+
+	streams := map[string]*DataStream{}
+	for origin, fileName := range map[string]string{"stagea": stageFile, "prod": prodFile} {
+		source, err := NewSource("file://" + fileName)
+		if err != nil {
+			t.Fatalf("Couldn't create source: %v", err)
+		}
+		streams[origin] = NewDataStream("ranger", source, new(jsonDecoder))
+	}
+
+	// Someone else following just stagea sees its events as they are
+	plain, _ := NewSubscribeRequest(16, DropNewest, 0)
+	streams["stagea"].Subscribe(plain)
+	defer streams["stagea"].Unsubscribe(plain)
+
+	request, _ := NewSubscribeRequest(16, DropNewest, 0)
+	for origin, stream := range streams {
+		sibling := request.Sibling(origin)
+		stream.Subscribe(sibling)
+		defer stream.Unsubscribe(sibling)
+	}
+
+	received := map[string][]interface{}{}
+	for i := 0; i < 4; i++ {
+		select {
+		case data := <-request.dataChan:
+			origin, _ := GetDeep(originField, data)
+			servlet, _ := GetDeep("servlet", data)
+			received[fmt.Sprint(origin)] = append(received[fmt.Sprint(origin)], servlet)
+		case <-time.After(5e9):
+			t.Fatalf("Timed out with %v", received)
+		}
+	}
+	for origin, servlets := range map[string]string{"stagea": "[home biz]", "prod": "[search user]"} {
+		if fmt.Sprint(received[origin]) != servlets {
+			t.Errorf("Expected %s's events in order, tagged as from %s, but got %v", servlets, origin, received)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, tagged := GetDeep(originField, <-plain.dataChan); tagged {
+			t.Errorf("Expected events to be tagged for merged subscribers only")
+		}
+	}
+}
+
+func TestFinishedStatusIsNeverDropped(t *testing.T) {
+	request, _ := NewSubscribeRequest(1, DropNewest, 0)
+	request.unsubscribed = make(chan bool)
+	for i := 0; i <= cap(request.statusChan); i++ {
+		request.sendStatus(&StreamStatus{State: StatusDegraded})
+	}
+
+	sent := make(chan bool)
+	go func() {
+		request.sendLastStatus(&StreamStatus{State: StatusFinished})
+		sent <- true
+	}()
+	for i := 0; i < cap(request.statusChan); i++ {
+		if status := <-request.statusChan; status.State != StatusDegraded {
+			t.Errorf("Expected the earlier statuses first, but got %s", status.State)
+		}
+	}
+	if status := <-request.statusChan; status.State != StatusFinished {
+		t.Errorf("Expected to be told the stream finished, but got %s", status.State)
+	}
+	<-sent
+
+	// Nobody waits on a subscriber that's gone
+	for i := 0; i < cap(request.statusChan); i++ {
+		request.sendStatus(&StreamStatus{State: StatusDegraded})
+	}
+	close(request.unsubscribed)
+	go func() {
+		request.sendLastStatus(&StreamStatus{State: StatusFinished})
+		sent <- true
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5e9):
+		t.Errorf("Expected not to wait on an unsubscribed request")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"json"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Decoder turns one line from the upstream into the same map[string]interface{} shape json.Unmarshal
+// gives us, so GetDeep, filters and windows work on any format. Decoders may keep state between lines
+// (like a CSV header), which Reset() throws away when the upstream reconnects. A line that isn't an
+// event, like that header, decodes to nil data and a nil err.
+type Decoder interface {
+	Decode(line []byte) (data JSONData, err os.Error)
+	Reset()
+	String() string
+}
+
+// Formats are named as:
+//
+//   json             One JSON object per line (the default)
+//   logfmt           key=value key2="quoted value"
+//   csv              Comma separated, with the column names taken from the first line
+//   csv:a,b,c        Comma separated, with the given column names
+//   combined         Apache combined (or common) access log
+func NewDecoder(format string) (decoder Decoder, err os.Error) {
+	switch {
+	case format == "" || format == "json":
+		return new(jsonDecoder), nil
+	case format == "logfmt":
+		return new(logfmtDecoder), nil
+	case format == "csv":
+		return new(csvDecoder), nil
+	case strings.HasPrefix(format, "csv:"):
+		header := splitCSV(format[len("csv:"):])
+		return &csvDecoder{fixedHeader: header, header: header}, nil
+	case format == "combined":
+		return new(combinedDecoder), nil
+	}
+	return nil, fmt.Errorf("Unknown format '%s', expected one of json, logfmt, csv, csv:<columns> or combined", format)
+}
+
+// Values from text formats that look like numbers become float64, just like they would from JSON.
+func textValue(text string) interface{} {
+	if number, err := strconv.Atof64(text); err == nil {
+		return number
+	}
+	return text
+}
+
+/*
+ * json
+ */
+type jsonDecoder struct{}
+
+func (d *jsonDecoder) Decode(line []byte) (data JSONData, err os.Error) {
+	err = json.Unmarshal(line, &data)
+	return
+}
+
+func (d *jsonDecoder) Reset() {}
+
+func (d *jsonDecoder) String() string {
+	return "json"
+}
+
+/*
+ * logfmt
+ *
+ * Space separated key=value pairs. Values may be double quoted (with backslash escapes), and a key on its
+ * own is taken to be true.
+ */
+type logfmtDecoder struct{}
+
+func (d *logfmtDecoder) Decode(line []byte) (data JSONData, err os.Error) {
+	event := make(map[string]interface{})
+	text := string(line)
+
+	for pos := 0; pos < len(text); {
+		if text[pos] == ' ' || text[pos] == '\t' {
+			pos++
+			continue
+		}
+
+		keyStart := pos
+		for pos < len(text) && text[pos] != '=' && text[pos] != ' ' && text[pos] != '\t' {
+			pos++
+		}
+		key := text[keyStart:pos]
+		if pos >= len(text) || text[pos] != '=' {
+			event[key] = true
+			continue
+		}
+		pos++
+
+		if pos < len(text) && text[pos] == '"' {
+			valueStart := pos
+			for pos++; pos < len(text) && text[pos] != '"'; pos++ {
+				if text[pos] == '\\' {
+					pos++
+				}
+			}
+			if pos >= len(text) {
+				return nil, fmt.Errorf("Unterminated quoted value for '%s' at column %d", key, valueStart+1)
+			}
+			pos++
+			value, err := strconv.Unquote(text[valueStart:pos])
+			if err != nil {
+				return nil, fmt.Errorf("Bad quoted value for '%s' at column %d: %v", key, valueStart+1, err)
+			}
+			event[key] = value
+		} else {
+			valueStart := pos
+			for pos < len(text) && text[pos] != ' ' && text[pos] != '\t' {
+				pos++
+			}
+			event[key] = textValue(text[valueStart:pos])
+		}
+	}
+
+	if len(event) == 0 {
+		return nil, fmt.Errorf("No key=value pairs found")
+	}
+	return event, nil
+}
+
+func (d *logfmtDecoder) Reset() {}
+
+func (d *logfmtDecoder) String() string {
+	return "logfmt"
+}
+
+/*
+ * csv and csv:<columns>
+ */
+type csvDecoder struct {
+	fixedHeader []string // Columns we were configured with, if any
+	header      []string
+}
+
+func (d *csvDecoder) Decode(line []byte) (data JSONData, err os.Error) {
+	fields := splitCSV(string(line))
+	if d.header == nil {
+		d.header = fields
+		return nil, nil
+	}
+	if len(fields) != len(d.header) {
+		return nil, fmt.Errorf("Expected %d CSV columns, got %d", len(d.header), len(fields))
+	}
+
+	event := make(map[string]interface{}, len(fields))
+	for ndx, field := range fields {
+		event[d.header[ndx]] = textValue(field)
+	}
+	return event, nil
+}
+
+// A new connection starts a new file, which comes with a header of its own.
+func (d *csvDecoder) Reset() {
+	d.header = d.fixedHeader
+}
+
+func (d *csvDecoder) String() string {
+	if d.fixedHeader != nil {
+		return "csv:" + strings.Join(d.fixedHeader, ",")
+	}
+	return "csv"
+}
+
+// Splits a line of CSV into fields. Fields may be double quoted, with "" for a literal quote.
+func splitCSV(line string) (fields []string) {
+	field := []byte{}
+	quoted := false
+	for pos := 0; pos < len(line); pos++ {
+		c := line[pos]
+		switch {
+		case quoted && c == '"' && pos+1 < len(line) && line[pos+1] == '"':
+			field = append(field, '"')
+			pos++
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			fields = append(fields, string(field))
+			field = []byte{}
+		default:
+			field = append(field, c)
+		}
+	}
+	return append(fields, string(field))
+}
+
+/*
+ * combined
+ *
+ * host ident user [time] "METHOD /uri PROTOCOL" status bytes "referer" "user agent"
+ * The referer and user agent are optional, so the common log format works too.
+ */
+type combinedDecoder struct{}
+
+var combinedRe = regexp.MustCompile(`^([^ ]+) ([^ ]+) ([^ ]+) \[([^\]]+)\] "([^"]*)" ([0-9]+) ([0-9]+|-)( "([^"]*)" "([^"]*)")?`)
+
+func (d *combinedDecoder) Decode(line []byte) (data JSONData, err os.Error) {
+	matches := combinedRe.FindStringSubmatch(string(line))
+	if matches == nil {
+		return nil, fmt.Errorf("Not a combined log line")
+	}
+
+	event := map[string]interface{}{
+		"remote_addr": matches[1],
+		"ident":       matches[2],
+		"user":        matches[3],
+		"time":        matches[4],
+		"request":     matches[5],
+		"status":      textValue(matches[6]),
+		"bytes":       textValue(matches[7]),
+	}
+	if request := strings.Fields(matches[5]); len(request) == 3 {
+		event["method"], event["uri"], event["protocol"] = request[0], request[1], request[2]
+	}
+	if matches[8] != "" {
+		event["referer"], event["user_agent"] = matches[9], matches[10]
+	}
+	return event, nil
+}
+
+func (d *combinedDecoder) Reset() {}
+
+func (d *combinedDecoder) String() string {
+	return "combined"
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+type decodeTest struct {
+	format string
+	lines  []string
+	events []JSONData
+}
+
+var decodeTests = []decodeTest{
+	decodeTest{"json", []string{`{"a": 1, "b": "foo"}`}, []JSONData{
+		map[string]interface{}{"a": 1., "b": "foo"},
+	}},
+	decodeTest{"logfmt", []string{`servlet=home timing=12.5 msg="hello \"world\"" cached`}, []JSONData{
+		map[string]interface{}{"servlet": "home", "timing": 12.5, "msg": `hello "world"`, "cached": true},
+	}},
+	decodeTest{"csv", []string{"servlet,timing", "home,12", `"biz, inc",40`}, []JSONData{
+		nil,
+		map[string]interface{}{"servlet": "home", "timing": 12.},
+		map[string]interface{}{"servlet": "biz, inc", "timing": 40.},
+	}},
+	decodeTest{"csv:servlet,timing", []string{`home,""`}, []JSONData{
+		map[string]interface{}{"servlet": "home", "timing": ""},
+	}},
+	decodeTest{"combined", []string{`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /biz/foo HTTP/1.0" 200 2326 "http://www.example.com/" "Mozilla/4.08"`}, []JSONData{
+		map[string]interface{}{
+			"remote_addr": "127.0.0.1",
+			"ident":       "-",
+			"user":        "frank",
+			"time":        "10/Oct/2000:13:55:36 -0700",
+			"request":     "GET /biz/foo HTTP/1.0",
+			"method":      "GET",
+			"uri":         "/biz/foo",
+			"protocol":    "HTTP/1.0",
+			"status":      200.,
+			"bytes":       2326.,
+			"referer":     "http://www.example.com/",
+			"user_agent":  "Mozilla/4.08",
+		},
+	}},
+}
+
+func TestDecoders(t *testing.T) {
+	for _, test := range decodeTests {
+		decoder, err := NewDecoder(test.format)
+		if err != nil {
+			t.Fatalf("Couldn't create %s decoder: %v", test.format, err)
+		}
+		for ndx, line := range test.lines {
+			event, err := decoder.Decode([]byte(line))
+			if err != nil {
+				t.Errorf("For %s line '%s', expected nil err, but was %v", test.format, line, err)
+			}
+			if !reflect.DeepEqual(event, test.events[ndx]) {
+				t.Errorf("For %s line '%s', expected %v, but was %v", test.format, line, test.events[ndx], event)
+			}
+		}
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	if _, err := NewDecoder("xml"); err == nil {
+		t.Errorf("Expected an unknown format to be rejected")
+	}
+
+	decoder, _ := NewDecoder("csv:a,b")
+	if _, err := decoder.Decode([]byte("1,2,3")); err == nil {
+		t.Errorf("Expected a CSV line with too many columns to fail")
+	}
+
+	decoder, _ = NewDecoder("combined")
+	if _, err := decoder.Decode([]byte("not an access log")); err == nil {
+		t.Errorf("Expected a garbage access log line to fail")
+	}
+}
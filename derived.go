@@ -0,0 +1,480 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"http"
+	"io"
+	"io/ioutil"
+	"json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var derivedConfig = flag.String("derived", "", "JSON file of derived streams to register at startup, parents before children")
+
+// A named stream made from another log by a saved query, e.g. "ranger errors only". The query is evaluated
+// once, server-side, and any number of clients can subscribe to the (much smaller) result by Name.
+type DerivedStream struct {
+	Name    string
+	Log     string    // The log it's derived from. May itself be a derived stream.
+	Source  string    // Source URL for Log. Defaults to the derived stream named Log, or the default source.
+	Format  string    // Format of Log
+	Join    *JoinSpec // Instead of Log, match up the events of two logs
+	Filters []string  // Only events passing all of these make it through
+	Fields  []string  // If set, events are projected down to these fields, named as the expression. Otherwise they pass through whole.
+}
+
+// Joins two logs on a key, e.g. ranger's unique_request_id with a backend timing log's request_id. Each match
+// is one event with the two sides' events under their names, so filters and fields can refer to e.g. ranger.servlet.
+type JoinSpec struct {
+	Sides        []JoinSide // Exactly two
+	Window       string     // How far apart matching events can arrive, e.g. "30s"
+	MaxUnmatched int        // Most events each side holds on to waiting for a match
+}
+
+type JoinSide struct {
+	Log    string
+	Source string
+	Format string
+	Key    string // GetDeep path to match on
+	As     string // Name for this side's events in the match. Defaults to Log.
+}
+
+var (
+	derivedLock    sync.Mutex
+	derivedSources = make(map[string]*derivedSource)
+)
+
+// Returns the source of the derived stream with this name, if there is one.
+func DerivedSource(name string) (source Source, ok bool) {
+	derivedLock.Lock()
+	defer derivedLock.Unlock()
+
+	derived, ok := derivedSources[name]
+	if !ok {
+		return nil, false
+	}
+	return derived, true
+}
+
+// Makes a derived stream available to StreamByName and clients. Its log (or parent derived stream) is only
+// followed while someone is subscribed.
+func RegisterDerivedStream(def *DerivedStream) (err os.Error) {
+	if def.Name == "" {
+		return fmt.Errorf("Derived streams need a name")
+	}
+	if (def.Log == "") == (def.Join == nil) {
+		return fmt.Errorf("Derived stream %s needs either a log or a join", def.Name)
+	}
+	for _, statement := range append(append([]string{}, def.Filters...), def.Fields...) {
+		if _, err = Parse(statement); err != nil {
+			return fmt.Errorf("Couldn't parse \"%s\" for %s: %v", statement, def.Name, err)
+		}
+	}
+
+	derivedLock.Lock()
+	defer derivedLock.Unlock()
+
+	if _, exists := derivedSources[def.Name]; exists {
+		return fmt.Errorf("There's already a derived stream called %s", def.Name)
+	}
+
+	source := &derivedSource{def: def}
+	if def.Join == nil {
+		parent, err := newDerivedParent(def.Name, JoinSide{Log: def.Log, Source: def.Source, Format: def.Format})
+		if err != nil {
+			return err
+		}
+		source.parents = []*derivedParent{parent}
+	} else {
+		if err = source.setupJoin(def.Join); err != nil {
+			return err
+		}
+	}
+
+	derivedSources[def.Name] = source
+	log.Printf("Registered derived stream %v", source)
+	return nil
+}
+
+// Registers each of the derived streams in a JSON file, a list of DerivedStream objects.
+func LoadDerivedStreams(path string) (err os.Error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	defs := []*DerivedStream{}
+	if err = json.Unmarshal(contents, &defs); err != nil {
+		return fmt.Errorf("Couldn't read derived streams from %s: %v", path, err)
+	}
+	for _, def := range defs {
+		if err = RegisterDerivedStream(def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * derived://
+ *
+ * Subscribes to the parent stream (or both sides of a join) and hands on, as JSON lines, the events passing
+ * the derived stream's query. Derived streams are ordinary DataStreams on top of this, with their own history,
+ * cache and subscribers.
+ */
+type derivedSource struct {
+	def     *DerivedStream
+	parents []*derivedParent
+
+	// For joins
+	window       int64
+	maxUnmatched int
+
+	lock    sync.Mutex
+	dropped int64 // Parent events we dropped for not keeping up with them
+}
+
+type derivedParent struct {
+	log    string
+	source Source
+	format string
+	key    string
+	name   string
+}
+
+// Call holding derivedLock. Parents have to be registered first, which also keeps us out of cycles.
+func newDerivedParent(name string, side JoinSide) (parent *derivedParent, err os.Error) {
+	if side.Log == name {
+		return nil, fmt.Errorf("Derived stream %s can't be derived from itself", name)
+	}
+	parent = &derivedParent{log: side.Log, format: side.Format, key: side.Key, name: side.As}
+	if parent.name == "" {
+		parent.name = side.Log
+	}
+
+	parent.source = defaultSource
+	if side.Source != "" {
+		parent.source, err = NewSource(side.Source)
+		if err != nil {
+			return nil, err
+		}
+	} else if derived, ok := derivedSources[side.Log]; ok {
+		parent.source = derived
+	}
+	if parent.source == nil {
+		return nil, fmt.Errorf("No source for %s", side.Log)
+	}
+	return parent, nil
+}
+
+// Call holding derivedLock.
+func (s *derivedSource) setupJoin(join *JoinSpec) (err os.Error) {
+	if len(join.Sides) != 2 {
+		return fmt.Errorf("Join for %s needs two sides, not %d", s.def.Name, len(join.Sides))
+	}
+	for _, side := range join.Sides {
+		if side.Log == "" || side.Key == "" {
+			return fmt.Errorf("Each side of the join for %s needs a log and a key", s.def.Name)
+		}
+		parent, err := newDerivedParent(s.def.Name, side)
+		if err != nil {
+			return err
+		}
+		s.parents = append(s.parents, parent)
+	}
+	if s.parents[0].name == s.parents[1].name {
+		return fmt.Errorf("Both sides of the join for %s are called %s, give one a different name with \"as\"", s.def.Name, s.parents[0].name)
+	}
+
+	s.window = defaultJoinWindow
+	if join.Window != "" {
+		s.window, err = ParseDuration(join.Window)
+		if err != nil {
+			return err
+		}
+	}
+	s.maxUnmatched = defaultJoinMaxUnmatched
+	if join.MaxUnmatched > 0 {
+		s.maxUnmatched = join.MaxUnmatched
+	}
+	return nil
+}
+
+// Room for a parent to get ahead of us. Beyond that we drop its events, like any other subscriber, rather than
+// hold up everyone else reading the parent.
+const derivedBufferSize = 256
+
+func (s *derivedSource) Open(logName string) (stream io.ReadCloser, err os.Error) {
+	parents := []*DataStream{}
+	requests := []*SubscribeRequest{}
+	for _, parent := range s.parents {
+		parentStream, err := StreamBySource(parent.log, parent.source, parent.format)
+		if err != nil {
+			for _, opened := range parents {
+				ReleaseStream(opened)
+			}
+			return nil, err
+		}
+		request, _ := NewSubscribeRequest(derivedBufferSize, DropNewest, 0)
+		parents = append(parents, parentStream)
+		requests = append(requests, request)
+	}
+
+	reader, writer := io.Pipe()
+	derived := &derivedReader{PipeReader: reader, done: make(chan bool)}
+	for ndx, parent := range parents {
+		parent.Subscribe(requests[ndx])
+	}
+	go s.pump(parents, requests, writer, derived.done)
+	return derived, nil
+}
+
+// A derived stream comes to an end when its parents do.
+func (s *derivedSource) Finite() bool {
+	for _, parent := range s.parents {
+		if !isFinite(parent.source) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *derivedSource) String() string {
+	return "derived://" + s.def.Name
+}
+
+// Evaluates the parents' events until the derived stream hangs up or the parents finish.
+func (s *derivedSource) pump(parents []*DataStream, requests []*SubscribeRequest, writer *io.PipeWriter, done chan bool) {
+	defer func() {
+		for ndx, parent := range parents {
+			parent.Unsubscribe(requests[ndx])
+			ReleaseStream(parent)
+		}
+	}()
+	defer writer.Close()
+	defer s.countDropped(requests)
+
+	reportTicker := time.NewTicker(reportInterval)
+	defer reportTicker.Stop()
+
+	query := NewScribeQuery(stringsToInterfaces(s.def.Fields), stringsToInterfaces(s.def.Filters))
+
+	// Without a join there's no second side, and receiving from its nil channels never happens.
+	var join *joiner
+	var otherData chan JSONData
+	var otherStatus chan *StreamStatus
+	if len(s.parents) == 2 {
+		join = newJoiner([2]string{s.parents[0].name, s.parents[1].name}, [2]string{s.parents[0].key, s.parents[1].key}, s.window, s.maxUnmatched)
+		defer func() { log.Printf("Join for %s done, %v", s.def.Name, join) }()
+		otherData, otherStatus = requests[1].dataChan, requests[1].statusChan
+	}
+
+	// Hands on an event from one side, if it makes it through. Returns false once the derived stream has hung up.
+	handle := func(side int, data JSONData) bool {
+		if join != nil {
+			var matched bool
+			if data, matched = join.Add(side, data, time.Nanoseconds()); !matched {
+				return true
+			}
+		}
+		line, ok := s.derive(query, data)
+		if !ok {
+			return true
+		}
+		_, err := writer.Write(line)
+		return err == nil
+	}
+
+	// A parent's events are all delivered before it says it's finished, but we may not have got to them yet.
+	drain := func() {
+		for side, request := range requests {
+			for len(request.dataChan) > 0 {
+				if !handle(side, <-request.dataChan) {
+					return
+				}
+			}
+		}
+	}
+
+	finished := 0
+	for {
+		var data JSONData
+		side := 0
+		select {
+		case <-done:
+			return
+		case <-reportTicker.C:
+			s.countDropped(requests)
+			continue
+		case status := <-requests[0].statusChan:
+			if status.State == StatusFinished {
+				if finished++; finished == len(parents) {
+					drain()
+					return
+				}
+			}
+			continue
+		case status := <-otherStatus:
+			if status.State == StatusFinished {
+				if finished++; finished == len(parents) {
+					drain()
+					return
+				}
+			}
+			continue
+		case data = <-requests[0].dataChan:
+		case data = <-otherData:
+			side = 1
+		}
+
+		if !handle(side, data) {
+			return
+		}
+	}
+}
+
+func (s *derivedSource) countDropped(requests []*SubscribeRequest) {
+	var dropped int64
+	for _, request := range requests {
+		dropped += request.TakeDropped()
+	}
+	if dropped == 0 {
+		return
+	}
+	log.Printf("Derived stream %s fell behind its parents and dropped %d events", s.def.Name, dropped)
+
+	s.lock.Lock()
+	s.dropped += dropped
+	s.lock.Unlock()
+}
+
+// How many parent events we've dropped for not keeping up, in all.
+func (s *derivedSource) Dropped() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+// Returns the line for the derived stream, if the event passes its filters.
+func (s *derivedSource) derive(query *ScribeQuery, data JSONData) (line []byte, ok bool) {
+	outputPairs, passes, err := query.Evaluate(data)
+	if err != nil {
+		log.Printf("Got error evaluating %s: %v", s.def.Name, err)
+		return nil, false
+	}
+	if !passes {
+		return nil, false
+	}
+
+	output := data
+	if len(s.def.Fields) > 0 {
+		fields := make(map[string]interface{}, len(outputPairs))
+		for ndx, pair := range outputPairs {
+			// Fields missing from the event stay missing
+			pair := pair.([]interface{})
+			if len(pair) < 2 {
+				continue
+			}
+			// Paths keep their shape, so timing.total can be found as timing.total again downstream
+			if _, isPath := query.displayFields[ndx].(*GetDeepExpression); isPath {
+				setDeep(fields, pair[0].(string), pair[1])
+			} else {
+				fields[pair[0].(string)] = pair[1]
+			}
+		}
+		output = fields
+	}
+
+	line, err = json.Marshal(output)
+	if err != nil {
+		log.Printf("Failed to encode %s: %v", s.def.Name, err)
+		return nil, false
+	}
+	return append(line, '\n'), true
+}
+
+// Sets path in fields to value, making objects along the way. Objects already there are copied rather than
+// changed, since they may be part of the parent's event.
+func setDeep(fields map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		inner := make(map[string]interface{})
+		if existing, ok := fields[key].(map[string]interface{}); ok {
+			for k, v := range existing {
+				inner[k] = v
+			}
+		}
+		fields[key] = inner
+		fields = inner
+	}
+	fields[keys[len(keys)-1]] = value
+}
+
+func stringsToInterfaces(values []string) (result []interface{}) {
+	for _, value := range values {
+		result = append(result, value)
+	}
+	return
+}
+
+type derivedReader struct {
+	*io.PipeReader
+	done      chan bool
+	closeOnce sync.Once
+}
+
+func (r *derivedReader) Close() os.Error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return r.PipeReader.Close()
+}
+
+// /admin/derive?name=ranger_errors&log=ranger&filter=...&field=...&field=... with optional source and format, or
+// /admin/derive?name=ranger_timing&join=ranger:unique_request_id&join=backend_timing:request_id&window=30s&maxUnmatched=10000
+func ServeDerive(writer http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		http.Error(writer, err.String(), http.StatusBadRequest)
+		return
+	}
+	def := &DerivedStream{
+		Name:    request.FormValue("name"),
+		Log:     request.FormValue("log"),
+		Source:  request.FormValue("source"),
+		Format:  request.FormValue("format"),
+		Filters: request.Form["filter"],
+		Fields:  request.Form["field"],
+	}
+	if def.Source != "" {
+		if _, err := NewQuerySource(def.Source); err != nil {
+			http.Error(writer, err.String(), http.StatusBadRequest)
+			return
+		}
+	}
+	if sides := request.Form["join"]; len(sides) > 0 {
+		def.Join = &JoinSpec{Window: request.FormValue("window")}
+		for _, side := range sides {
+			colonNdx := strings.Index(side, ":")
+			if colonNdx < 0 {
+				http.Error(writer, fmt.Sprintf("Expected log:key to join on, got %s", side), http.StatusBadRequest)
+				return
+			}
+			def.Join.Sides = append(def.Join.Sides, JoinSide{Log: side[:colonNdx], Key: side[colonNdx+1:]})
+		}
+		if maxUnmatched := request.FormValue("maxUnmatched"); maxUnmatched != "" {
+			var err os.Error
+			if def.Join.MaxUnmatched, err = strconv.Atoi(maxUnmatched); err != nil {
+				http.Error(writer, "maxUnmatched should be a number", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if err := RegisterDerivedStream(def); err != nil {
+		http.Error(writer, err.String(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(writer, "Registered %s\n", def.Name)
+}
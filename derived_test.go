@@ -0,0 +1,191 @@
+package main
+
+import (
+	"json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var derivedFixture = `{"servlet": "home", "timing": {"total": 12}}
+{"servlet": "biz", "timing": {"total": 40}}
+{"servlet": "search", "timing": {"total": 7}}
+{"servlet": "user", "timing": {"total": 21}}
+`
+
+func TestDerivedStream(t *testing.T) {
+	fileName := writeFixture(t, derivedFixture)
+	defer os.Remove(fileName)
+
+	def := &DerivedStream{
+		Name:    "ranger_every_other",
+		Log:     "ranger",
+		Source:  "file://" + fileName,
+		Filters: []string{"EveryNth(2)"},
+		Fields:  []string{"servlet"},
+	}
+	if err := RegisterDerivedStream(def); err != nil {
+		t.Fatalf("Couldn't register: %v", err)
+	}
+	if err := RegisterDerivedStream(def); err == nil {
+		t.Errorf("Expected registering the same name twice to fail")
+	}
+
+	stream := StreamByName("ranger_every_other")
+	defer ReleaseStream(stream)
+	request, _ := NewSubscribeRequest(16, DropNewest, 0)
+	stream.Subscribe(request)
+	defer stream.Unsubscribe(request)
+
+	for _, servlet := range []string{"biz", "user"} {
+		select {
+		case data := <-request.dataChan:
+			fields, _ := data.(map[string]interface{})
+			if len(fields) != 1 || fields["servlet"] != servlet {
+				t.Errorf("Expected just servlet %s, but got %v", servlet, data)
+			}
+		case <-time.After(5e9):
+			t.Fatalf("Timed out waiting for %s", servlet)
+		}
+	}
+}
+
+func TestDerivedFieldsKeepTheirShape(t *testing.T) {
+	var data JSONData
+	if err := json.Unmarshal([]byte(`{"servlet": "home", "timing": {"total": 12, "backend": 5}}`), &data); err != nil {
+		t.Fatal(err)
+	}
+	fields := []string{"timing", "timing.total", "servlet", `As(Lower(servlet), "lower")`, "Upper(servlet)", "not_there.at_all"}
+	s := &derivedSource{def: &DerivedStream{Name: "ranger_shaped", Fields: fields}}
+	line, ok := s.derive(NewScribeQuery(stringsToInterfaces(fields), nil), data)
+	if !ok {
+		t.Fatalf("Expected the event to be derived")
+	}
+
+	var derived JSONData
+	if err := json.Unmarshal(line, &derived); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"timing":         map[string]interface{}{"total": 12., "backend": 5.},
+		"servlet":        "home",
+		"lower":          "home",
+		"Upper(servlet)": "HOME",
+	}
+	if !reflect.DeepEqual(derived, expected) {
+		t.Errorf("Expected %v, got %v", expected, derived)
+	}
+	if total, _ := GetDeep("timing.total", derived); total != 12. {
+		t.Errorf("Expected timing.total to be found again, got %v", total)
+	}
+}
+
+func TestDerivedStreamFinishesWithItsParent(t *testing.T) {
+	fileName := writeFixture(t, derivedFixture)
+	defer os.Remove(fileName)
+
+	def := &DerivedStream{Name: "ranger_replayed", Log: "ranger", Source: "replay://" + fileName + "?speed=max", Filters: []string{`servlet != "search"`}}
+	if err := RegisterDerivedStream(def); err != nil {
+		t.Fatalf("Couldn't register: %v", err)
+	}
+	stream := StreamByName("ranger_replayed")
+	defer ReleaseStream(stream)
+	request, _ := NewSubscribeRequest(16, DropNewest, 0)
+	stream.Subscribe(request)
+	defer stream.Unsubscribe(request)
+
+	for _, servlet := range []string{"home", "biz", "user"} {
+		select {
+		case data := <-request.dataChan:
+			if value, _ := GetDeep("servlet", data); value != servlet {
+				t.Errorf("Expected servlet %s, but was %v", servlet, value)
+			}
+		case <-time.After(5e9):
+			t.Fatalf("Timed out waiting for %s", servlet)
+		}
+	}
+
+	deadline := time.After(5e9)
+	for {
+		select {
+		case status := <-request.statusChan:
+			if status.State == StatusFinished {
+				waitForStop(t, stream)
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Timed out waiting for the derived stream to finish")
+		}
+	}
+}
+
+var timingFixture = `{"request_id": "r2", "backend_ms": 31}
+{"request_id": "r3", "backend_ms": 5}
+`
+
+func TestJoinedStream(t *testing.T) {
+	rangerName := writeFixture(t, `{"unique_request_id": "r1", "servlet": "home"}
+{"unique_request_id": "r2", "servlet": "biz"}
+`)
+	defer os.Remove(rangerName)
+	timingName := writeFixture(t, timingFixture)
+	defer os.Remove(timingName)
+
+	def := &DerivedStream{
+		Name: "ranger_timing",
+		Join: &JoinSpec{
+			Sides: []JoinSide{
+				JoinSide{Log: "ranger", Source: "file://" + rangerName, Key: "unique_request_id"},
+				JoinSide{Log: "timing", Source: "file://" + timingName, Key: "request_id"},
+			},
+			Window: "1m",
+		},
+		Fields: []string{"ranger.servlet", "timing.backend_ms"},
+	}
+	if err := RegisterDerivedStream(def); err != nil {
+		t.Fatalf("Couldn't register: %v", err)
+	}
+
+	stream := StreamByName("ranger_timing")
+	defer ReleaseStream(stream)
+	request, _ := NewSubscribeRequest(16, DropNewest, 0)
+	stream.Subscribe(request)
+	defer stream.Unsubscribe(request)
+
+	select {
+	case data := <-request.dataChan:
+		fields, _ := data.(map[string]interface{})
+		servlet, _ := GetDeep("ranger.servlet", data)
+		backend, _ := GetDeep("timing.backend_ms", data)
+		if len(fields) != 2 || servlet != "biz" || backend != float64(31) {
+			t.Errorf("Expected biz joined with 31ms, but got %v", data)
+		}
+	case <-time.After(5e9):
+		t.Fatalf("Timed out waiting for the join")
+	}
+}
+
+var badDerivedStreams = []*DerivedStream{
+	&DerivedStream{Log: "ranger"},
+	&DerivedStream{Name: "ranger_nothing"},
+	&DerivedStream{Name: "ranger_both", Log: "ranger", Source: "file:///tmp", Join: &JoinSpec{}},
+	&DerivedStream{Name: "ranger_one_side", Join: &JoinSpec{Sides: []JoinSide{JoinSide{Log: "ranger", Source: "file:///tmp", Key: "id"}}}},
+	&DerivedStream{Name: "ranger_no_key", Join: &JoinSpec{Sides: []JoinSide{JoinSide{Log: "ranger", Source: "file:///tmp", Key: "id"}, JoinSide{Log: "timing", Source: "file:///tmp"}}}},
+	&DerivedStream{Name: "ranger_self_join", Join: &JoinSpec{Sides: []JoinSide{JoinSide{Log: "ranger", Source: "file:///tmp", Key: "id"}, JoinSide{Log: "ranger", Source: "file:///tmp", Key: "id"}}}},
+	&DerivedStream{Name: "ranger_bad_window", Join: &JoinSpec{Sides: []JoinSide{JoinSide{Log: "ranger", Source: "file:///tmp", Key: "id"}, JoinSide{Log: "timing", Source: "file:///tmp", Key: "id"}}, Window: "soon"}},
+	&DerivedStream{Name: "ranger", Log: "ranger", Source: "file:///tmp"},
+	&DerivedStream{Name: "ranger_bad_filter", Log: "ranger", Source: "file:///tmp", Filters: []string{"Nonsense(1)"}},
+	&DerivedStream{Name: "ranger_bad_source", Log: "ranger", Source: "gopher://localhost"},
+}
+
+func TestBadDerivedStreams(t *testing.T) {
+	for _, def := range badDerivedStreams {
+		if err := RegisterDerivedStream(def); err == nil {
+			t.Errorf("Expected %v to be rejected", def)
+		}
+		if _, ok := DerivedSource(def.Name); ok && def.Name != "" {
+			t.Errorf("Expected %s not to be registered", def.Name)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var durationUnits = []struct {
+	suffix string
+	ns     float64
+}{
+	{"ms", 1e6},
+	{"s", 1e9},
+	{"m", 60e9},
+	{"h", 3600e9},
+}
+
+// Parses durations such as "250ms", "30s", "5m" or "1.5h" into nanoseconds. A bare number is taken as seconds.
+func ParseDuration(duration string) (ns int64, err os.Error) {
+	number, scale := strings.TrimSpace(duration), 1e9
+	for _, unit := range durationUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, scale = number[:len(number)-len(unit.suffix)], unit.ns
+			break
+		}
+	}
+
+	value, err := strconv.Atof64(number)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Couldn't parse \"%s\" as a duration, expected something like 250ms, 30s, 5m or 1h", duration)
+	}
+	return int64(value * scale), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+type parseDurationTest struct {
+	duration string
+	ns       int64
+	ok       bool
+}
+
+var parseDurationTests = []parseDurationTest{
+	parseDurationTest{"250ms", 250e6, true},
+	parseDurationTest{"30s", 30e9, true},
+	parseDurationTest{"5m", 300e9, true},
+	parseDurationTest{"1.5h", 5400e9, true},
+	parseDurationTest{"10", 10e9, true},
+	parseDurationTest{" 2m ", 120e9, true},
+	parseDurationTest{"", 0, false},
+	parseDurationTest{"m", 0, false},
+	parseDurationTest{"-5s", 0, false},
+	parseDurationTest{"5 minutes", 0, false},
+}
+
+func TestParseDuration(t *testing.T) {
+	for _, test := range parseDurationTests {
+		ns, err := ParseDuration(test.duration)
+		if test.ok && err != nil {
+			t.Errorf("For duration '%s', expected nil err, but was %v", test.duration, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("For duration '%s', expected err, but was nil", test.duration)
+		}
+		if ns != test.ns {
+			t.Errorf("For duration '%s', expected %d ns, but was %d", test.duration, test.ns, ns)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// Serves a fake scribe tailer on the network, so rangerweb can be run away from the real ones.
+//
+//   faketailer -listen 127.0.0.1:3536 -fixtures ../testdata -rate 20
+//   rangerweb -source scribe-tail://127.0.0.1:3536
+package main
+
+import (
+	"faketailer"
+	"flag"
+	"log"
+	"net"
+)
+
+var (
+	listenAddress = flag.String("listen", "127.0.0.1:3536", "Address to listen for rangerweb on")
+	fixturesDir   = flag.String("fixtures", "", "Directory of per-log fixture files, named after the log with an optional .jsonl")
+	rate          = flag.Float64("rate", 10, "Events per second to send each client. 0 sends as fast as the client reads")
+	loop          = flag.Bool("loop", false, "Start fixtures over once they run out, rather than going quiet")
+)
+
+func main() {
+	flag.Parse()
+
+	listener, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		log.Fatal("Failed to listen: ", err)
+	}
+	log.Println("Fake tailer listening on", listener.Addr())
+
+	tailer := &faketailer.Tailer{Fixtures: *fixturesDir, Rate: *rate, Loop: *loop}
+	log.Fatal("Failed to accept: ", tailer.Serve(listener))
+}
@@ -0,0 +1,176 @@
+// A stand-in for a scribe tailer, so rangerweb can be run and tested away from the real ones. The faketailer
+// command in cmd serves it on the network, and rangerweb's tests serve it to themselves.
+//
+// It speaks the same protocol: a client connects, sends the name of a log followed by a newline, and gets
+// newline delimited JSON back for as long as it stays connected. Logs come from <fixtures>/<logName> or
+// <fixtures>/<logName>.jsonl if there is one, and otherwise are made up by a generator.
+package faketailer
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What a tailer serves, and how fast.
+type Tailer struct {
+	Fixtures string  // Directory of per-log fixture files, named after the log with an optional .jsonl
+	Rate     float64 // Events per second to send each client. 0 sends as fast as the client reads
+	Loop     bool    // Start fixtures over once they run out, rather than going quiet
+}
+
+// Where a client's events come from
+type eventSource interface {
+	// Returns the next line, without its newline, or os.EOF once there's no more.
+	Next() (line []byte, err os.Error)
+}
+
+// Serves each client that connects to the listener, until accepting fails, e.g. because the listener was closed.
+func (tailer *Tailer) Serve(listener net.Listener) os.Error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go tailer.serveClient(conn)
+	}
+	return nil
+}
+
+func (tailer *Tailer) serveClient(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	logName, err := reader.ReadString('\n')
+	if err != nil {
+		log.Printf("Failed to read a log name from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	logName = strings.TrimSpace(logName)
+
+	events, err := tailer.sourceFor(logName)
+	if err != nil {
+		log.Printf("Can't tail %s for %v: %v", logName, conn.RemoteAddr(), err)
+		return
+	}
+	log.Printf("Tailing %s to %v from %v", logName, conn.RemoteAddr(), events)
+
+	// Clients never say anything more, so a read returning means they've gone
+	gone := make(chan bool)
+	go func() {
+		reader.ReadByte()
+		close(gone)
+	}()
+
+	var ticker <-chan int64
+	if tailer.Rate > 0 {
+		pacer := time.NewTicker(int64(1e9 / tailer.Rate))
+		defer pacer.Stop()
+		ticker = pacer.C
+	}
+
+	writer := bufio.NewWriter(conn)
+	for {
+		line, err := events.Next()
+		if err == os.EOF {
+			// Like a real tailer, we go quiet rather than hanging up, once whatever's buffered is sent
+			if err = writer.Flush(); err != nil {
+				return
+			}
+			<-gone
+			return
+		}
+		if err != nil {
+			log.Printf("Failed reading %s: %v", logName, err)
+			return
+		}
+
+		if ticker != nil {
+			select {
+			case <-ticker:
+			case <-gone:
+				return
+			}
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+		// Without pacing, let the buffer fill up before sending
+		if ticker != nil || writer.Buffered() > 4096 {
+			if err = writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (tailer *Tailer) sourceFor(logName string) (events eventSource, err os.Error) {
+	if tailer.Fixtures != "" {
+		for _, name := range []string{logName, logName + ".jsonl"} {
+			path := filepath.Join(tailer.Fixtures, name)
+			if _, err := os.Stat(path); err == nil {
+				return newFixture(path, tailer.Loop)
+			}
+		}
+	}
+	return newGenerator(logName, time.Nanoseconds()), nil
+}
+
+// Plays back the lines of a file, once or over and over.
+type fixture struct {
+	path   string
+	loop   bool
+	file   *os.File
+	reader *bufio.Reader
+}
+
+func newFixture(path string, loop bool) (f *fixture, err os.Error) {
+	f = &fixture{path: path, loop: loop}
+	if err = f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fixture) open() (err os.Error) {
+	f.file, err = os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	f.reader = bufio.NewReader(f.file)
+	return nil
+}
+
+func (f *fixture) Next() (line []byte, err os.Error) {
+	for {
+		line, err = f.reader.ReadBytes('\n')
+		if len(line) > 0 && err == os.EOF {
+			// A last line without a newline still counts
+			err = nil
+		}
+		if err == os.EOF && f.loop {
+			f.file.Close()
+			if err = f.open(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			f.file.Close()
+			return nil, err
+		}
+		line = []byte(strings.TrimRight(string(line), "\r\n"))
+		if len(line) == 0 {
+			continue
+		}
+		return line, nil
+	}
+	return
+}
+
+func (f *fixture) String() string {
+	return f.path
+}
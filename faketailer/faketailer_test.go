@@ -0,0 +1,118 @@
+package faketailer
+
+import (
+	"bufio"
+	"io/ioutil"
+	"json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixtureLoops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faketailer")
+	if err != nil {
+		t.Fatalf("Couldn't create fixtures: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ranger.jsonl")
+	if err = ioutil.WriteFile(path, []byte("{\"n\": 1}\n\n{\"n\": 2}"), 0644); err != nil {
+		t.Fatalf("Couldn't write fixture: %v", err)
+	}
+
+	once, _ := newFixture(path, false)
+	looped, _ := newFixture(path, true)
+	for _, expected := range []string{`{"n": 1}`, `{"n": 2}`} {
+		if line, err := once.Next(); string(line) != expected || err != nil {
+			t.Errorf("Expected %s, but got %s, %v", expected, line, err)
+		}
+	}
+	if _, err := once.Next(); err != os.EOF {
+		t.Errorf("Expected EOF at the end, but was %v", err)
+	}
+
+	for _, expected := range []string{`{"n": 1}`, `{"n": 2}`, `{"n": 1}`, `{"n": 2}`} {
+		if line, err := looped.Next(); string(line) != expected || err != nil {
+			t.Errorf("Expected %s when looping, but got %s, %v", expected, line, err)
+		}
+	}
+}
+
+func TestGeneratorMakesJSON(t *testing.T) {
+	g := newGenerator("ranger", 1)
+	for i := 0; i < 100; i++ {
+		line, err := g.Next()
+		if err != nil {
+			t.Fatalf("Unexpected err %v", err)
+		}
+		var event map[string]interface{}
+		if err = json.Unmarshal(line, &event); err != nil {
+			t.Fatalf("Couldn't decode %s: %v", line, err)
+		}
+		if event["log"] != "ranger" || event["unique_request_id"] == nil || event["servlet"] == nil {
+			t.Errorf("Expected a ranger event, but got %s", line)
+		}
+	}
+}
+
+func TestServeClient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	defer listener.Close()
+	go new(Tailer).Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ranger\n"))
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 10; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("Failed reading event %d: %v", i, err)
+		}
+		var event map[string]interface{}
+		if err = json.Unmarshal(line, &event); err != nil || event["log"] != "ranger" {
+			t.Errorf("Expected a ranger event, but got %s", line)
+		}
+	}
+}
+
+func TestServeSendsAllOfAFixture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "faketailer")
+	if err != nil {
+		t.Fatalf("Couldn't create fixtures: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "ranger"), []byte("{\"n\": 1}\n{\"n\": 2}\n"), 0644); err != nil {
+		t.Fatalf("Couldn't write fixture: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	defer listener.Close()
+	go (&Tailer{Fixtures: dir}).Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ranger\n"))
+
+	// Unpaced, a short fixture is all still buffered when it runs out
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{"{\"n\": 1}\n", "{\"n\": 2}\n"} {
+		if line, err := reader.ReadString('\n'); line != expected || err != nil {
+			t.Errorf("Expected %q, but got %q, %v", expected, line, err)
+		}
+	}
+}
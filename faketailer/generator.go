@@ -0,0 +1,51 @@
+package faketailer
+
+import (
+	"fmt"
+	"json"
+	"os"
+	"rand"
+	"time"
+)
+
+var servlets = []string{"home", "biz", "search", "user", "review", "talk"}
+
+// Makes up ranger-ish events: a servlet, a unique request id, a start time, a status and some timings.
+type generator struct {
+	logName string
+	random  *rand.Rand
+	count   int64
+}
+
+func newGenerator(logName string, seed int64) *generator {
+	return &generator{logName, rand.New(rand.NewSource(seed)), 0}
+}
+
+func (g *generator) Next() (line []byte, err os.Error) {
+	g.count++
+	status := 200
+	switch roll := g.random.Intn(100); {
+	case roll < 2:
+		status = 500
+	case roll < 7:
+		status = 404
+	}
+	total := g.random.ExpFloat64() * 80
+	event := map[string]interface{}{
+		"log":               g.logName,
+		"servlet":           servlets[g.random.Intn(len(servlets))],
+		"unique_request_id": fmt.Sprintf("%016x", g.random.Int63()),
+		"start_time":        float64(time.Nanoseconds()) / 1e9,
+		"status":            status,
+		"sequence":          g.count,
+		"timing": map[string]interface{}{
+			"total":   total,
+			"backend": total * g.random.Float64(),
+		},
+	}
+	return json.Marshal(event)
+}
+
+func (g *generator) String() string {
+	return "a generator"
+}
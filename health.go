@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"http"
+	"io"
+	"json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var idleTimeout = flag.String("idle-timeout", "60s", "Reconnect to a live upstream that has sent nothing for this long. 0 disables")
+
+// Shorter idle timeouts are taken as this. Silence that short says nothing about the upstream, and watchIdle
+// can't check for it anyway.
+const minIdleTimeout = 1e9
+
+// The -idle-timeout flag in nanoseconds. main() makes sure it parses.
+func idleTimeoutNs() int64 {
+	timeout, _ := ParseDuration(*idleTimeout)
+	if timeout > 0 && timeout < minIdleTimeout {
+		return minIdleTimeout
+	}
+	return timeout
+}
+
+// Counts things per second over the last rateWindow whole seconds.
+const rateWindow = 10
+
+type rateMeter struct {
+	// One more slot than the window, for the second we're in the middle of
+	counts  [rateWindow + 1]int64
+	seconds [rateWindow + 1]int64 // Which second each count is for
+}
+
+func (m *rateMeter) Add(count int64, now int64) {
+	second := now / 1e9
+	ndx := second % (rateWindow + 1)
+	if m.seconds[ndx] != second {
+		m.seconds[ndx], m.counts[ndx] = second, 0
+	}
+	m.counts[ndx] += count
+}
+
+func (m *rateMeter) Rate(now int64) float64 {
+	second := now / 1e9
+	var total int64
+	for ndx, counted := range m.seconds {
+		// The current second isn't over yet, so leave it out
+		if counted < second && counted >= second-rateWindow {
+			total += m.counts[ndx]
+		}
+	}
+	return float64(total) / rateWindow
+}
+
+// How a stream is doing, kept up to date by the goroutine reading it.
+type streamHealth struct {
+	lock sync.Mutex
+
+	lastEventAt    int64 // Nanoseconds, zero if we've never had one
+	connectedAt    int64 // Nanoseconds, zero if we're not connected
+	events         int64
+	bytes          int64
+	decodeFailures int64
+	oversizeLines  int64
+	reconnects     int64
+	shed           int64   // Events dropped by the stream's sampler
+	sampleRate     float64 // The fraction of events the sampler is keeping
+	eventRate      rateMeter
+	byteRate       rateMeter
+}
+
+func (h *streamHealth) Event(size int, now int64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastEventAt = now
+	h.events++
+	h.bytes += int64(size)
+	h.eventRate.Add(1, now)
+	h.byteRate.Add(int64(size), now)
+}
+
+func (h *streamHealth) DecodeFailure() {
+	h.lock.Lock()
+	h.decodeFailures++
+	h.lock.Unlock()
+}
+
+func (h *streamHealth) Sampled(kept bool, fraction float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !kept {
+		h.shed++
+	}
+	h.sampleRate = fraction
+}
+
+// Returns how many oversize lines we've now skipped.
+func (h *streamHealth) OversizeLine() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.oversizeLines++
+	return h.oversizeLines
+}
+
+func (h *streamHealth) Connected(connected bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if connected {
+		if h.lastEventAt != 0 {
+			h.reconnects++
+		}
+		h.connectedAt = time.Nanoseconds()
+	} else {
+		h.connectedAt = 0
+	}
+}
+
+// How long since we last heard anything, or since we connected if we've heard nothing on this connection.
+func (h *streamHealth) Silence(now int64) int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.lastEventAt > h.connectedAt {
+		return now - h.lastEventAt
+	}
+	return now - h.connectedAt
+}
+
+// The health of a stream as we report it to clients and at /streams
+func (stream *DataStream) Health() map[string]interface{} {
+	state, running := stream.Status().State, stream.Running()
+
+	h := stream.health
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Nanoseconds()
+	report := map[string]interface{}{
+		"stream":         stream.name,
+		"source":         stream.source.String(),
+		"format":         stream.decoder.String(),
+		"state":          state,
+		"running":        running,
+		"events":         h.events,
+		"bytes":          h.bytes,
+		"eventsPerSec":   h.eventRate.Rate(now),
+		"bytesPerSec":    h.byteRate.Rate(now),
+		"decodeFailures": h.decodeFailures,
+		"oversizeLines":  h.oversizeLines,
+		"reconnects":     h.reconnects,
+	}
+	if stream.maxRate > 0 {
+		report["maxRate"] = stream.maxRate
+		report["sampleRate"] = h.sampleRate
+		report["shed"] = h.shed
+	}
+	if derived, ok := stream.source.(*derivedSource); ok {
+		report["parentDrops"] = derived.Dropped()
+	}
+	if h.lastEventAt != 0 {
+		report["secsSinceLastEvent"] = float64(now-h.lastEventAt) / 1e9
+	}
+	if h.connectedAt != 0 {
+		report["secsConnected"] = float64(now-h.connectedAt) / 1e9
+	}
+	return report
+}
+
+// Closes the upstream if it goes quiet for longer than timeout, so run() reconnects, and lets it know on idled.
+// Returns once done is closed.
+func (stream *DataStream) watchIdle(rawStream io.Closer, timeout int64, done chan bool, idled chan bool) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if silence := stream.health.Silence(now); silence > timeout {
+				log.Printf("Nothing from %s for %.0fs, reconnecting", stream.name, float64(silence)/1e9)
+				idled <- true
+				rawStream.Close()
+				return
+			}
+		}
+	}
+}
+
+type healthReports []map[string]interface{}
+
+func (r healthReports) Len() int      { return len(r) }
+func (r healthReports) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r healthReports) Less(i, j int) bool {
+	return r[i]["stream"].(string)+r[i]["source"].(string) < r[j]["stream"].(string)+r[j]["source"].(string)
+}
+
+// /streams lists the health of every stream we know about
+func ServeStreams(writer http.ResponseWriter, request *http.Request) {
+	reports := healthReports{}
+	for _, stream := range scribeStreams.All() {
+		reports = append(reports, stream.Health())
+	}
+	sort.Sort(reports)
+
+	outputBytes, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		log.Printf("Failed to format stream health: %v", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(outputBytes)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"http/httptest"
+	"io"
+	"json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateMeter(t *testing.T) {
+	var meter rateMeter
+	start := int64(1000e9)
+
+	// 5 a second for the last 10 seconds, plus some in the current second which shouldn't count yet
+	for second := int64(0); second < rateWindow; second++ {
+		meter.Add(5, start+second*1e9)
+	}
+	meter.Add(100, start+rateWindow*1e9)
+
+	if rate := meter.Rate(start + rateWindow*1e9 + 5e8); rate != 5 {
+		t.Errorf("Expected 5/sec, but was %v", rate)
+	}
+
+	// Once everything is older than the window, the rate drops to nothing
+	if rate := meter.Rate(start + 3*rateWindow*1e9); rate != 0 {
+		t.Errorf("Expected 0/sec after going quiet, but was %v", rate)
+	}
+}
+
+func TestStreamHealthSilence(t *testing.T) {
+	health := new(streamHealth)
+	health.Connected(true)
+	connectedAt := health.connectedAt
+
+	if silence := health.Silence(connectedAt + 5e9); silence != 5e9 {
+		t.Errorf("Expected silence to be counted from connecting, but was %d", silence)
+	}
+
+	health.Event(10, connectedAt+7e9)
+	if silence := health.Silence(connectedAt + 8e9); silence != 1e9 {
+		t.Errorf("Expected silence to be counted from the last event, but was %d", silence)
+	}
+}
+
+func TestIdleTimeoutIsClamped(t *testing.T) {
+	defer func(original string) { *idleTimeout = original }(*idleTimeout)
+	for timeout, expected := range map[string]int64{"30s": 30e9, "0": 0, "250ms": minIdleTimeout, "0.000001ms": minIdleTimeout} {
+		*idleTimeout = timeout
+		if ns := idleTimeoutNs(); ns != expected {
+			t.Errorf("Expected an idle timeout of %s to be %d, but was %d", timeout, expected, ns)
+		}
+	}
+}
+
+// A live source that sends one event on each connection, saying which it was, and then nothing until it's closed.
+type quietSource struct {
+	lock  sync.Mutex
+	opens int
+}
+
+func (s *quietSource) Open(logName string) (io.ReadCloser, os.Error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.opens++
+	reader, writer := io.Pipe()
+	go writer.Write([]byte(`{"connection": ` + strconv.Itoa(s.opens) + "}\n"))
+	return reader, nil
+}
+
+func (s *quietSource) Live() bool {
+	return true
+}
+
+func (s *quietSource) String() string {
+	return "quiet://"
+}
+
+func TestIdleUpstreamIsReconnected(t *testing.T) {
+	stream := NewDataStream("ranger", new(quietSource), new(jsonDecoder))
+	stream.idleTimeout = 100e6
+	request, _ := NewSubscribeRequest(16, DropNewest, 0)
+	request.statusChan = make(chan *StreamStatus, 64)
+	stream.Subscribe(request)
+	defer stream.Unsubscribe(request)
+
+	for _, connection := range []float64{1, 2} {
+		select {
+		case data := <-request.dataChan:
+			if value, _ := GetDeep("connection", data); value != connection {
+				t.Errorf("Expected an event from connection %v, but got %v", connection, data)
+			}
+		case <-time.After(5e9):
+			t.Fatalf("Timed out waiting for connection %v", connection)
+		}
+	}
+
+	idled := false
+	for len(request.statusChan) > 0 {
+		status := <-request.statusChan
+		idled = idled || status.State == StatusDegraded && strings.Contains(status.Message, "nothing received")
+	}
+	if !idled {
+		t.Errorf("Expected subscribers to be told the upstream went quiet")
+	}
+	if reconnects, _ := stream.Health()["reconnects"].(int64); reconnects < 1 {
+		t.Errorf("Expected the reconnect to be counted, but was %d", reconnects)
+	}
+}
+
+func TestServeStreams(t *testing.T) {
+	source := new(endlessSource)
+	streams := []*DataStream{}
+	for _, format := range []string{"logfmt", "json"} {
+		stream, err := StreamBySource("streams_test", source, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ReleaseStream(stream)
+		streams = append(streams, stream)
+	}
+	request, _ := NewSubscribeRequest(16, DropNewest, 0)
+	streams[1].Subscribe(request)
+	defer streams[1].Unsubscribe(request)
+	receiveOne(t, request)
+
+	response := httptest.NewRecorder()
+	ServeStreams(response, nil)
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected JSON, but was %s", contentType)
+	}
+	var reports []map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &reports); err != nil {
+		t.Fatalf("Couldn't decode %s: %v", response.Body, err)
+	}
+
+	formats := []interface{}{}
+	for _, report := range reports {
+		if report["stream"] != "streams_test" {
+			continue
+		}
+		formats = append(formats, report["format"])
+		if report["source"] != "endless://" {
+			t.Errorf("Expected the endless source, but was %v", report["source"])
+		}
+		if running := report["format"] == "json"; report["running"] != running {
+			t.Errorf("Expected only the subscribed stream to be running, but %v was %v", report["format"], report["running"])
+		}
+		if report["format"] == "json" && report["events"].(float64) < 1 {
+			t.Errorf("Expected the subscribed stream to have had events, but was %v", report["events"])
+		}
+	}
+	if len(formats) != 2 {
+		t.Errorf("Expected both streams to be listed, but found %v", formats)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	historyLength    = flag.String("history", "10m", "How much recent data each stream keeps around to backfill new queries")
+	historyMaxEvents = flag.Int("history-events", 100000, "Most events each stream keeps around to backfill new queries")
+	historyMaxBytes  = flag.Int("history-bytes", 64*1024*1024, "Most bytes of recent events each stream keeps around to backfill new queries")
+)
+
+// The -history flag in nanoseconds. main() makes sure it parses.
+func historyMaxAge() int64 {
+	maxAge, _ := ParseDuration(*historyLength)
+	return maxAge
+}
+
+type HistoryEvent struct {
+	Timestamp int64 // Nanoseconds, when we received it
+	Data      JSONData
+}
+
+type historyEntry struct {
+	event HistoryEvent
+	size  int // As it came off the wire
+}
+
+// A time ordered ring buffer of a stream's recent events, so a new query can start with some context.
+// Events older than maxAge, or beyond the most recent maxEvents or maxBytes (as they came off the wire), are let go.
+// Most streams never get asked for a backfill, so nothing is kept until the first query that asks for one.
+type eventHistory struct {
+	maxAge    int64
+	maxEvents int
+	maxBytes  int
+
+	lock    sync.Mutex
+	enabled bool
+	ring    []historyEntry // Grown as needed, up to maxEvents
+	start   int            // Index of the oldest event
+	count   int
+	bytes   int
+}
+
+// The ring starts this small and doubles as it fills.
+const minHistoryRing = 1024
+
+func newEventHistory(maxAge int64, maxEvents int, maxBytes int) *eventHistory {
+	return &eventHistory{maxAge: maxAge, maxEvents: maxEvents, maxBytes: maxBytes}
+}
+
+// Starts keeping events, if we weren't already, for the queries that will want them.
+func (h *eventHistory) Enable() {
+	h.lock.Lock()
+	h.enabled = true
+	h.lock.Unlock()
+}
+
+func (h *eventHistory) Add(data JSONData, size int) {
+	if h.maxAge <= 0 || h.maxEvents <= 0 || size > h.maxBytes {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.enabled {
+		return
+	}
+	now := time.Nanoseconds()
+	h.expire(now)
+
+	if h.count == len(h.ring) {
+		if len(h.ring) < h.maxEvents {
+			h.grow()
+		} else {
+			h.dropOldest()
+		}
+	}
+	h.ring[(h.start+h.count)%len(h.ring)] = historyEntry{HistoryEvent{now, data}, size}
+	h.count++
+	h.bytes += size
+
+	for h.bytes > h.maxBytes {
+		h.dropOldest()
+	}
+}
+
+// Returns the events received at or after since (in nanoseconds), oldest first.
+func (h *eventHistory) Since(since int64) (events []HistoryEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.count == 0 {
+		return
+	}
+	h.expire(time.Nanoseconds())
+
+	first := sort.Search(h.count, func(i int) bool {
+		return h.ring[(h.start+i)%len(h.ring)].event.Timestamp >= since
+	})
+	events = make([]HistoryEvent, 0, h.count-first)
+	for i := first; i < h.count; i++ {
+		events = append(events, h.ring[(h.start+i)%len(h.ring)].event)
+	}
+	return
+}
+
+// How many events we're holding on to, and their size.
+func (h *eventHistory) Size() (count int, bytes int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.count, h.bytes
+}
+
+func (h *eventHistory) expire(now int64) {
+	for h.count > 0 && h.ring[h.start].event.Timestamp < now-h.maxAge {
+		h.dropOldest()
+	}
+}
+
+func (h *eventHistory) grow() {
+	size := len(h.ring) * 2
+	if size < minHistoryRing {
+		size = minHistoryRing
+	}
+	if size > h.maxEvents {
+		size = h.maxEvents
+	}
+	ring := make([]historyEntry, size)
+	for i := 0; i < h.count; i++ {
+		ring[i] = h.ring[(h.start+i)%len(h.ring)]
+	}
+	h.ring, h.start = ring, 0
+}
+
+func (h *eventHistory) dropOldest() {
+	h.bytes -= h.ring[h.start].size
+	// Clear it out so the event can be garbage collected
+	h.ring[h.start] = historyEntry{}
+	h.start = (h.start + 1) % len(h.ring)
+	h.count--
+}
+
+// Merges the backlogs of several streams into one, in the order the events arrived.
+type mergedHistory []HistoryEvent
+
+func (m mergedHistory) Len() int           { return len(m) }
+func (m mergedHistory) Less(i, j int) bool { return m[i].Timestamp < m[j].Timestamp }
+func (m mergedHistory) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+func mergeHistories(histories [][]HistoryEvent) (events []HistoryEvent) {
+	for _, history := range histories {
+		events = append(events, history...)
+	}
+	sort.Sort(mergedHistory(events))
+	return
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventHistoryBounds(t *testing.T) {
+	history := newEventHistory(60e9, 3, 1024)
+	history.Enable()
+	for _, value := range []float64{1, 2, 3, 4, 5} {
+		history.Add(value, 1)
+	}
+
+	events := history.Since(0)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, but got %d", len(events))
+	}
+	for ndx, expected := range []float64{3, 4, 5} {
+		if events[ndx].Data != expected {
+			t.Errorf("Event %d: expected %v, but was %v", ndx, expected, events[ndx].Data)
+		}
+	}
+
+	if events := history.Since(time.Nanoseconds() + 1e9); len(events) != 0 {
+		t.Errorf("Expected nothing from the future, but got %d events", len(events))
+	}
+}
+
+func TestEventHistoryExpiry(t *testing.T) {
+	history := newEventHistory(1e6, 10, 1024)
+	history.Enable()
+	history.Add(1., 1)
+	time.Sleep(2e6)
+	history.Add(2., 1)
+
+	events := history.Since(0)
+	if len(events) != 1 || events[0].Data != 2. {
+		t.Errorf("Expected only the newest event to survive, but got %v", events)
+	}
+}
+
+func TestEventHistoryByteBound(t *testing.T) {
+	history := newEventHistory(60e9, 10, 100)
+	history.Enable()
+	for _, value := range []float64{1, 2, 3} {
+		history.Add(value, 40)
+	}
+	history.Add(4., 101)
+
+	events := history.Since(0)
+	if len(events) != 2 || events[0].Data != 2. || events[1].Data != 3. {
+		t.Errorf("Expected the newest 80 bytes of events, and nothing too big to ever fit, but got %v", events)
+	}
+	if count, bytes := history.Size(); count != 2 || bytes != 80 {
+		t.Errorf("Expected 2 events and 80 bytes, but was %d and %d", count, bytes)
+	}
+}
+
+func TestEventHistoryWaitsForABackfill(t *testing.T) {
+	history := newEventHistory(60e9, 5000, 1024*1024)
+	history.Add(0., 1)
+	if count, _ := history.Size(); count != 0 || history.ring != nil {
+		t.Errorf("Expected nothing to be kept before anyone asked, but had %d events", count)
+	}
+
+	// Once asked, the ring grows as it fills, keeping the events in order
+	history.Enable()
+	for i := 1; i <= 2500; i++ {
+		history.Add(float64(i), 1)
+	}
+	events := history.Since(0)
+	if len(events) != 2500 || len(history.ring) != 4096 {
+		t.Fatalf("Expected 2500 events in a ring of 4096, but had %d in %d", len(events), len(history.ring))
+	}
+	for ndx, event := range events {
+		if event.Data != float64(ndx+1) {
+			t.Fatalf("Event %d: expected %d, but was %v", ndx, ndx+1, event.Data)
+		}
+	}
+}
+
+func TestStreamKeepsHistoryOnceAsked(t *testing.T) {
+	stream := NewDataStream("ranger", new(endlessSource), new(jsonDecoder))
+	plain, _ := NewSubscribeRequest(4, DropNewest, 0)
+	stream.Subscribe(plain)
+	defer stream.Unsubscribe(plain)
+	receiveOne(t, plain)
+	receiveOne(t, plain)
+	if count, _ := stream.history.Size(); count != 0 {
+		t.Errorf("Expected no history without a backfill, but had %d events", count)
+	}
+
+	// The first backfill has nothing to go on, but the next one does
+	first, _ := NewSubscribeRequest(4, DropNewest, 0)
+	first.SetBackfill(60e9, 1)
+	stream.Subscribe(first)
+	defer stream.Unsubscribe(first)
+	if backlog := <-first.backlogChan; len(backlog) != 0 {
+		t.Errorf("Expected an empty backlog, but got %d events", len(backlog))
+	}
+	receiveOne(t, first)
+
+	second, _ := NewSubscribeRequest(4, DropNewest, 0)
+	second.SetBackfill(60e9, 1)
+	stream.Subscribe(second)
+	defer stream.Unsubscribe(second)
+	if backlog := <-second.backlogChan; len(backlog) == 0 {
+		t.Errorf("Expected a backlog once the history was kept")
+	}
+}
+
+func TestMergeHistories(t *testing.T) {
+	merged := mergeHistories([][]HistoryEvent{
+		[]HistoryEvent{HistoryEvent{1, "a"}, HistoryEvent{4, "d"}},
+		[]HistoryEvent{HistoryEvent{2, "b"}, HistoryEvent{3, "c"}},
+	})
+	for ndx, expected := range []string{"a", "b", "c", "d"} {
+		if merged[ndx].Data != expected {
+			t.Errorf("Event %d: expected %v, but was %v", ndx, expected, merged[ndx].Data)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+)
+
+// Defaults for joins that don't say, in nanoseconds and events.
+const (
+	defaultJoinWindow       = 30e9
+	defaultJoinMaxUnmatched = 10000
+)
+
+// Matches up events from two sides whose values at their key paths are equal, e.g. ranger's
+// unique_request_id with a backend timing log's request_id, as long as they arrive within window of each other.
+// Each side holds on to at most maxUnmatched events waiting for a match, letting the oldest go first.
+type joiner struct {
+	names        [2]string // Each side's event goes under its name in the merged event
+	keys         [2]string // GetDeep paths
+	window       int64
+	maxUnmatched int
+
+	unmatched [2]map[string]*list.Element
+	order     [2]list.List // *pendingEvent, oldest first
+
+	matched int64
+	expired int64 // Went unmatched for longer than the window
+	evicted int64 // Let go early to stay under maxUnmatched
+}
+
+type pendingEvent struct {
+	key  string
+	data JSONData
+	at   int64
+}
+
+func newJoiner(names [2]string, keys [2]string, window int64, maxUnmatched int) *joiner {
+	j := &joiner{names: names, keys: keys, window: window, maxUnmatched: maxUnmatched}
+	for side := 0; side < 2; side++ {
+		j.unmatched[side] = make(map[string]*list.Element)
+		j.order[side].Init()
+	}
+	return j
+}
+
+// Returns the merged event if data matches one waiting on the other side. Otherwise data waits for its match.
+// Events without a key never match.
+func (j *joiner) Add(side int, data JSONData, now int64) (joined JSONData, ok bool) {
+	j.expire(now)
+
+	value, found := GetDeep(j.keys[side], data)
+	if !found || value == nil {
+		return nil, false
+	}
+	// Compare as text, so a numeric id on one side can match a string one on the other
+	key := fmt.Sprint(value)
+
+	other := 1 - side
+	if element, waiting := j.unmatched[other][key]; waiting {
+		pending := j.remove(other, element)
+		j.matched++
+		return map[string]interface{}{j.names[side]: data, j.names[other]: pending.data}, true
+	}
+
+	// Only the latest event for a key waits
+	if element, waiting := j.unmatched[side][key]; waiting {
+		j.remove(side, element)
+	}
+	j.unmatched[side][key] = j.order[side].PushBack(&pendingEvent{key, data, now})
+	for j.order[side].Len() > j.maxUnmatched {
+		j.remove(side, j.order[side].Front())
+		j.evicted++
+	}
+	return nil, false
+}
+
+// How many events are waiting for a match on each side
+func (j *joiner) Unmatched() (left int, right int) {
+	return j.order[0].Len(), j.order[1].Len()
+}
+
+func (j *joiner) String() string {
+	return fmt.Sprintf("%s.%s = %s.%s: %d matched, %d expired, %d evicted", j.names[0], j.keys[0], j.names[1], j.keys[1], j.matched, j.expired, j.evicted)
+}
+
+func (j *joiner) expire(now int64) {
+	for side := 0; side < 2; side++ {
+		for j.order[side].Len() > 0 {
+			oldest := j.order[side].Front()
+			if oldest.Value.(*pendingEvent).at >= now-j.window {
+				break
+			}
+			j.remove(side, oldest)
+			j.expired++
+		}
+	}
+}
+
+func (j *joiner) remove(side int, element *list.Element) *pendingEvent {
+	pending := element.Value.(*pendingEvent)
+	j.order[side].Remove(element)
+	j.unmatched[side][pending.key] = nil, false
+	return pending
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+)
+
+func joinEvent(key interface{}, servlet string) JSONData {
+	return map[string]interface{}{"id": key, "servlet": servlet}
+}
+
+func TestJoinMatches(t *testing.T) {
+	j := newJoiner([2]string{"ranger", "timing"}, [2]string{"id", "id"}, 10e9, 100)
+
+	if _, ok := j.Add(0, joinEvent("a", "home"), 1e9); ok {
+		t.Errorf("Expected nothing to match the first event")
+	}
+	if _, ok := j.Add(1, joinEvent("b", "biz"), 2e9); ok {
+		t.Errorf("Expected different keys not to match")
+	}
+	joined, ok := j.Add(1, joinEvent("a", "backend"), 3e9)
+	if !ok {
+		t.Fatalf("Expected a match on a")
+	}
+	if servlet, _ := GetDeep("ranger.servlet", joined); servlet != "home" {
+		t.Errorf("Expected ranger.servlet = home, but was %v", servlet)
+	}
+	if servlet, _ := GetDeep("timing.servlet", joined); servlet != "backend" {
+		t.Errorf("Expected timing.servlet = backend, but was %v", servlet)
+	}
+
+	// Each event matches once
+	if _, ok := j.Add(1, joinEvent("a", "again"), 4e9); ok {
+		t.Errorf("Expected a matched event not to match again")
+	}
+	if left, right := j.Unmatched(); left != 0 || right != 2 {
+		t.Errorf("Expected 0 and 2 unmatched, but was %d and %d", left, right)
+	}
+
+	// Numbers match their text on the other side
+	if _, ok := j.Add(0, joinEvent(float64(42), "home"), 5e9); ok {
+		t.Errorf("Expected nothing to match 42 yet")
+	}
+	if _, ok := j.Add(1, joinEvent("42", "backend"), 6e9); !ok {
+		t.Errorf("Expected 42 to match \"42\"")
+	}
+
+	// Events without the key are ignored
+	if _, ok := j.Add(0, map[string]interface{}{"servlet": "home"}, 7e9); ok {
+		t.Errorf("Expected an event without a key not to match")
+	}
+	if left, _ := j.Unmatched(); left != 0 {
+		t.Errorf("Expected events without a key not to be kept, but %d are waiting", left)
+	}
+}
+
+func TestJoinWindow(t *testing.T) {
+	j := newJoiner([2]string{"ranger", "timing"}, [2]string{"id", "id"}, 10e9, 100)
+
+	j.Add(0, joinEvent("a", "home"), 1e9)
+	if _, ok := j.Add(1, joinEvent("a", "backend"), 12e9); ok {
+		t.Errorf("Expected events further apart than the window not to match")
+	}
+	if j.expired != 1 {
+		t.Errorf("Expected 1 expired, but was %d", j.expired)
+	}
+	if left, right := j.Unmatched(); left != 0 || right != 1 {
+		t.Errorf("Expected 0 and 1 unmatched, but was %d and %d", left, right)
+	}
+}
+
+func TestJoinMaxUnmatched(t *testing.T) {
+	j := newJoiner([2]string{"ranger", "timing"}, [2]string{"id", "id"}, 10e9, 2)
+
+	for _, key := range []string{"a", "b", "c"} {
+		j.Add(0, joinEvent(key, "home"), 1e9)
+	}
+	if left, _ := j.Unmatched(); left != 2 {
+		t.Errorf("Expected 2 unmatched, but was %d", left)
+	}
+	if j.evicted != 1 {
+		t.Errorf("Expected 1 evicted, but was %d", j.evicted)
+	}
+	if _, ok := j.Add(1, joinEvent("a", "backend"), 2e9); ok {
+		t.Errorf("Expected the oldest to have been evicted")
+	}
+	if _, ok := j.Add(1, joinEvent("c", "backend"), 2e9); !ok {
+		t.Errorf("Expected the newest to still be waiting")
+	}
+}
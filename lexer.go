@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"unicode"
+	"utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEnd  tokenKind = iota
+	tokenName           // Function names and GetDeep paths, e.g. TimedWindow or timing.total
+	tokenNumber
+	tokenString
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+	tokenOperator // == != < <= > >= + - * /
+)
+
+type token struct {
+	kind   tokenKind
+	text   string      // As written in the statement, quotes and all
+	value  interface{} // For numbers and strings, what a Literal of it holds
+	column int         // Counting characters from 1, for error messages
+	offset int         // In bytes, for slicing the statement
+}
+
+func (t token) end() int {
+	return t.offset + len(t.text)
+}
+
+func (t token) String() string {
+	if t.kind == tokenEnd {
+		return "the end of the statement"
+	}
+	return strconv.Quote(t.text)
+}
+
+// A statement that doesn't parse, with where the trouble was found.
+type ParseError struct {
+	Column  int
+	Message string
+}
+
+func (e *ParseError) String() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Message)
+}
+
+/*
+ * Splits a statement into tokens: names, numbers, strings, parentheses, commas and operators. Strings may be quoted with
+ * ", ' or `, and a backslash escapes a quote or backslash inside them, or stands for a \n, \t or \r.
+ */
+type lexer struct {
+	statement string
+	offset    int
+	column    int
+}
+
+func lex(statement string) (tokens []token, err os.Error) {
+	l := &lexer{statement: statement, column: 1}
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == tokenEnd {
+			return tokens, nil
+		}
+	}
+	return
+}
+
+// The next character, or -1 at the end of the statement.
+func (l *lexer) peek() int {
+	if l.offset >= len(l.statement) {
+		return -1
+	}
+	c, _ := utf8.DecodeRuneInString(l.statement[l.offset:])
+	return c
+}
+
+func (l *lexer) advance() int {
+	if l.offset >= len(l.statement) {
+		return -1
+	}
+	c, size := utf8.DecodeRuneInString(l.statement[l.offset:])
+	l.offset += size
+	l.column++
+	return c
+}
+
+func (l *lexer) next() (tok token, err os.Error) {
+	for unicode.IsSpace(l.peek()) {
+		l.advance()
+	}
+
+	tok = token{column: l.column, offset: l.offset}
+	c := l.peek()
+	switch {
+	case c == -1:
+		tok.kind = tokenEnd
+		return tok, nil
+	case c == '(':
+		tok.kind = tokenLeftParen
+	case c == ')':
+		tok.kind = tokenRightParen
+	case c == ',':
+		tok.kind = tokenComma
+	case c == '"' || c == '\'' || c == '`':
+		return l.lexString(tok)
+	case c == '=' || c == '!' || c == '<' || c == '>' || c == '+' || c == '-' || c == '*' || c == '/':
+		return l.lexOperator(tok)
+	case isDigit(c):
+		return l.lexNumber(tok)
+	case isNameStart(c):
+		return l.lexName(tok)
+	case c == '@':
+		return tok, &ParseError{tok.column, "unexpected '@', fields with one in their name need GetDeep(\"...\")"}
+	default:
+		return tok, &ParseError{tok.column, fmt.Sprintf("unexpected %q", c)}
+	}
+	l.advance()
+	tok.text = l.statement[tok.offset:l.offset]
+	return tok, nil
+}
+
+func (l *lexer) lexName(tok token) (token, os.Error) {
+	for isNameStart(l.peek()) || isDigit(l.peek()) || l.peek() == '.' {
+		l.advance()
+	}
+	tok.kind = tokenName
+	tok.text = l.statement[tok.offset:l.offset]
+
+	// headers.X-Forwarded-For would otherwise quietly be headers.X - Forwarded - For
+	if l.peek() == '-' && l.offset+1 < len(l.statement) && isNameStart(int(l.statement[l.offset+1])) {
+		column := l.column
+		for isNameStart(l.peek()) || isDigit(l.peek()) || l.peek() == '.' || l.peek() == '-' {
+			l.advance()
+		}
+		name := l.statement[tok.offset:l.offset]
+		return tok, &ParseError{column, fmt.Sprintf("%s has a - in it, write GetDeep(%s) for the field or put spaces around - to subtract", name, strconv.Quote(name))}
+	}
+	return tok, nil
+}
+
+func (l *lexer) lexOperator(tok token) (token, os.Error) {
+	c := l.advance()
+	if l.peek() == '=' && (c == '=' || c == '!' || c == '<' || c == '>') {
+		l.advance()
+	} else if c == '=' {
+		return tok, &ParseError{tok.column, "unexpected '=', did you mean ==?"}
+	} else if c == '!' {
+		return tok, &ParseError{tok.column, "unexpected '!', did you mean != or not?"}
+	}
+	tok.kind = tokenOperator
+	tok.text = l.statement[tok.offset:l.offset]
+	return tok, nil
+}
+
+func (l *lexer) lexNumber(tok token) (token, os.Error) {
+	l.skipDigits()
+	if l.peek() == '.' {
+		l.advance()
+		l.skipDigits()
+	}
+	if c := l.peek(); c == 'e' || c == 'E' {
+		l.advance()
+		if c := l.peek(); c == '+' || c == '-' {
+			l.advance()
+		}
+		l.skipDigits()
+	}
+
+	tok.kind = tokenNumber
+	tok.text = l.statement[tok.offset:l.offset]
+	if i, err := strconv.Atoi(tok.text); err == nil {
+		tok.value = i
+	} else if f, err := strconv.Atof64(tok.text); err == nil {
+		tok.value = f
+	} else {
+		return tok, &ParseError{tok.column, fmt.Sprintf("%s is not a number", tok.text)}
+	}
+	return tok, nil
+}
+
+func (l *lexer) skipDigits() {
+	for isDigit(l.peek()) {
+		l.advance()
+	}
+}
+
+func (l *lexer) lexString(tok token) (token, os.Error) {
+	quote := l.advance()
+	value := []int{}
+	for {
+		column := l.column
+		c := l.advance()
+		switch c {
+		case -1:
+			return tok, &ParseError{tok.column, "string is never closed"}
+		case quote:
+			tok.kind = tokenString
+			tok.text = l.statement[tok.offset:l.offset]
+			tok.value = string(value)
+			return tok, nil
+		case '\\':
+			switch escaped := l.advance(); escaped {
+			case '\\', '"', '\'', '`':
+				c = escaped
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'r':
+				c = '\r'
+			case -1:
+				return tok, &ParseError{tok.column, "string is never closed"}
+			default:
+				return tok, &ParseError{column, fmt.Sprintf("unknown escape \\%c", escaped)}
+			}
+		}
+		value = append(value, c)
+	}
+	return tok, nil
+}
+
+func isDigit(c int) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isNameStart(c int) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var maxRates = flag.String("max-rate", "", "Most events per second each stream passes on, sampling evenly beyond that. Either one rate for every log, or log=rate pairs separated by commas, with an optional bare default. Unlimited if unset or 0")
+
+// The -max-rate for a log, zero if it's unlimited. main() makes sure it parses.
+func maxRateFor(logName string) float64 {
+	rate, _ := strconv.Atof64(perLogSetting(*maxRates, logName))
+	return rate
+}
+
+func checkMaxRates() os.Error {
+	for _, entry := range strings.Split(*maxRates, ",") {
+		rate := strings.TrimSpace(entry[strings.Index(entry, "=")+1:])
+		if rate == "" {
+			continue
+		}
+		if value, err := strconv.Atof64(rate); err != nil || value < 0 {
+			return fmt.Errorf("Expected a number of events per second, got '%s'", rate)
+		}
+	}
+	return nil
+}
+
+// Events kept by a sampling stream carry the number of upstream events each stands for, so counts can be scaled back up.
+const weightField = "_weight"
+
+// Sheds load by keeping an even fraction of a stream's events, sized so we pass on about maxRate a second.
+// The fraction is worked out from how busy the last second was, and picking which events to keep is
+// deterministic, every 1/fraction'th, rather than random. However busy the last second looked, no second
+// passes on more than maxRate.
+//
+// A kept event stands for itself and every event dropped since the last one we kept, rather than 1/fraction
+// of them. When a spike runs into the cap, the rest of that second is dropped on top of what the fraction
+// planned for, and the next event kept makes up for them.
+type sampler struct {
+	maxRate float64
+
+	second   int64   // The second we're counting
+	seen     float64 // Events this second
+	kept     float64 // Events kept this second
+	fraction float64 // Of events we're keeping this second
+	dropped  float64 // Events dropped since the last one we kept
+}
+
+func newSampler(maxRate float64) *sampler {
+	return &sampler{maxRate: maxRate, fraction: 1}
+}
+
+// Decides whether to keep an event arriving at now (in nanoseconds), and if so how many events it stands for.
+func (s *sampler) Sample(now int64) (keep bool, weight float64) {
+	if second := now / 1e9; second != s.second {
+		if second == s.second+1 && s.seen > s.maxRate {
+			s.fraction = s.maxRate / s.seen
+		} else {
+			s.fraction = 1
+		}
+		s.second, s.seen, s.kept = second, 0, 0
+	}
+	s.seen++
+
+	// Keep an event whenever the fraction of what we've seen this second comes to another whole one.
+	// The tiny extra keeps rounding from robbing us of an event, like 1000 * 0.1 coming to 99.99...
+	if s.kept >= s.maxRate || math.Floor(s.seen*s.fraction+1e-9) <= s.kept {
+		s.dropped++
+		return false, 0
+	}
+	s.kept++
+	weight = s.dropped + 1
+	s.dropped = 0
+	return true, weight
+}
+
+// The fraction of events we're keeping right now
+func (s *sampler) Fraction() float64 {
+	return s.fraction
+}
+
+// Tags a kept event with its weight. Events are fresh from the decoder at this point, so we don't need to copy.
+func withWeight(data JSONData, weight float64) JSONData {
+	if event, ok := data.(map[string]interface{}); ok {
+		event[weightField] = weight
+	}
+	return data
+}
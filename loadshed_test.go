@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSamplerUnderCap(t *testing.T) {
+	s := newSampler(100)
+	for i := int64(0); i < 300; i++ {
+		// 50 a second
+		keep, weight := s.Sample(i * 2e7)
+		if !keep || weight != 1 {
+			t.Fatalf("Event %d: expected to keep everything with weight 1, but got %t, %v", i, keep, weight)
+		}
+	}
+}
+
+func TestSamplerOverCap(t *testing.T) {
+	s := newSampler(100)
+	kept := make(map[int64]int)
+	var weights float64
+	for i := int64(0); i < 4000; i++ {
+		// 1000 a second, for 4 seconds
+		now := i * 1e6
+		keep, weight := s.Sample(now)
+		if !keep {
+			continue
+		}
+		kept[now/1e9]++
+		weights += weight
+
+		// The first second hits the cap after 100, and the first event kept after it makes up for the 900 dropped
+		switch {
+		case now < 1e9 && weight != 1:
+			t.Fatalf("Event %d: expected weight 1 before sampling, but was %v", i, weight)
+		case i == 1009 && weight != 910:
+			t.Fatalf("Event %d: expected weight 910 after the cap, but was %v", i, weight)
+		case now >= 1e9 && i != 1009 && weight != 10:
+			t.Fatalf("Event %d: expected weight 10 once sampling, but was %v", i, weight)
+		}
+	}
+
+	for second := int64(0); second < 4; second++ {
+		if kept[second] != 100 {
+			t.Errorf("Second %d: expected to keep 100, but kept %d", second, kept[second])
+		}
+	}
+	if weights != 4000 {
+		t.Errorf("Expected the weights to add up to the 4000 events, but they came to %v", weights)
+	}
+	if s.Fraction() != 0.1 {
+		t.Errorf("Expected to be keeping 0.1, but was %v", s.Fraction())
+	}
+
+	// Once it calms down we keep everything again
+	if keep, weight := s.Sample(5e9); !keep || weight != 1 {
+		t.Errorf("Expected to keep everything after a quiet second, but got %t, %v", keep, weight)
+	}
+}
+
+func TestSamplerIsDeterministic(t *testing.T) {
+	first, second := newSampler(10), newSampler(10)
+	for i := int64(0); i < 1000; i++ {
+		keep1, _ := first.Sample(i * 5e6)
+		keep2, _ := second.Sample(i * 5e6)
+		if keep1 != keep2 {
+			t.Fatalf("Event %d: samplers disagree", i)
+		}
+	}
+}
+
+func TestWindowSumOfWeights(t *testing.T) {
+	weights, _ := NewGetDeepExpression(weightField)
+	window := new(RollingWindow)
+	window.Setup("RollingWindow", []Expression{weights, &Literal{3}})
+	sum := new(WindowSum)
+	if err := sum.Setup("WindowSum", []Expression{window}); err != nil {
+		t.Fatalf("Couldn't set up WindowSum: %v", err)
+	}
+
+	expected := []float64{10, 20, 21, 13}
+	for ndx, weight := range []float64{10, 10, 1, 2} {
+		event := withWeight(map[string]interface{}{"servlet": "home"}, weight)
+		result, err := sum.Evaluate(event)
+		if err != nil {
+			t.Fatalf("Event %d: unexpected err %v", ndx, err)
+		}
+		if result != expected[ndx] {
+			t.Errorf("Event %d: expected %v, but was %v", ndx, expected[ndx], result)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+ * A field that isn't in an event and one that's there but null both evaluate to nil. Expressions that can tell the
+ * two apart, field lookups and As clauses of them, say whether their value is present as they look it up.
+ */
+type Presence interface {
+	Lookup(data JSONData) (result interface{}, present bool, err os.Error)
+}
+
+// Evaluates expr, and says whether its value is present. Only fields can be missing, anything else that
+// evaluates to nil is there, and null.
+func lookup(expr Expression, data JSONData) (result interface{}, present bool, err os.Error) {
+	if presence, ok := expr.(Presence); ok {
+		return presence.Lookup(data)
+	}
+	result, err = expr.Evaluate(data)
+	return result, true, err
+}
+
+/*
+ * Exists(field) -> bool
+ *
+ * Whether the field is in the event, even if it's null. The field is a path like timing.total, or a string of one.
+ */
+type Exists struct {
+	field Presence
+}
+
+func (e *Exists) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 1 {
+		return fmt.Errorf("Exists expects a single argument, a field")
+	}
+	if literal, ok := args[0].(*Literal); ok {
+		path, ok := literal.value.(string)
+		if !ok {
+			return fmt.Errorf("Exists expects a field, got %T %v", literal.value, literal.value)
+		}
+		e.field, err = NewGetDeepExpression(path)
+		return err
+	}
+	field, ok := args[0].(Presence)
+	if !ok {
+		return fmt.Errorf("Exists expects a field, not %v", args[0])
+	}
+	e.field = field
+	return nil
+}
+
+func (e *Exists) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	_, present, err := e.field.Lookup(data)
+	if err != nil {
+		return nil, err
+	}
+	return present, nil
+}
+
+func (e *Exists) String() string {
+	return fmt.Sprintf("Exists(%v)", e.field)
+}
+
+/*
+ * IsNull(value) -> bool
+ *
+ * Whether the value is null or missing, the same as value == null. Use Exists to tell the two apart.
+ */
+type IsNull struct {
+	expr Expression
+}
+
+func (n *IsNull) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 1 {
+		return fmt.Errorf("IsNull expects a single argument, the value to check")
+	}
+	n.expr = args[0]
+	return nil
+}
+
+func (n *IsNull) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	value, err := n.expr.Evaluate(data)
+	if err != nil {
+		return nil, err
+	}
+	return value == nil, nil
+}
+
+func (n *IsNull) String() string {
+	return fmt.Sprintf("IsNull(%v)", n.expr)
+}
+
+/*
+ * Coalesce(a, b, ...), Default(value, fallback) -> interface{}
+ *
+ * The first argument that's neither missing nor null, or nil if they all are. Later arguments are only evaluated
+ * if they're needed. Default is the same with exactly two, e.g. Default(servlet, "unknown").
+ */
+type Coalesce struct {
+	args  []Expression
+	fname string
+}
+
+func (c *Coalesce) Setup(fname string, args []Expression) (err os.Error) {
+	switch {
+	case fname == "Default" && len(args) != 2:
+		return fmt.Errorf("Default expects two arguments, a value and the fallback for when it's missing or null")
+	case fname == "Coalesce" && len(args) < 2:
+		return fmt.Errorf("Coalesce expects two or more arguments")
+	case fname != "Default" && fname != "Coalesce":
+		return fmt.Errorf("%v is not a supported Coalesce", fname)
+	}
+	c.args = args
+	c.fname = fname
+	return nil
+}
+
+func (c *Coalesce) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	for _, arg := range c.args {
+		if result, err = arg.Evaluate(data); err != nil || result != nil {
+			return result, err
+		}
+	}
+	return nil, nil
+}
+
+func (c *Coalesce) String() string {
+	return fmt.Sprintf("%s(%v)", c.fname, joinExpressions(c.args))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"json"
+	"reflect"
+	"testing"
+)
+
+var nullTests = []expressionTest{
+	expressionTest{"Exists(servlet)", true, true},
+	expressionTest{"Exists(referer)", true, true},
+	expressionTest{"Exists(not_there)", false, true},
+	expressionTest{"Exists(timing.total)", true, true},
+	expressionTest{"Exists(timing.backend)", false, true},
+	expressionTest{`Exists("timing.total")`, true, true},
+	expressionTest{`Exists("referer")`, true, true},
+	expressionTest{`Exists(GetDeep("not_there"))`, false, true},
+	expressionTest{"not Exists(not_there)", true, true},
+
+	expressionTest{"IsNull(referer)", true, true},
+	expressionTest{"IsNull(servlet)", false, true},
+	expressionTest{"IsNull(not_there)", true, true},
+	expressionTest{"IsNull(not_there) and not Exists(not_there)", true, true},
+	expressionTest{"IsNull(referer) and Exists(referer)", true, true},
+	expressionTest{"IsNull(Lower(not_there))", true, true},
+	expressionTest{"IsNull(null)", true, true},
+
+	expressionTest{"referer == null", true, true},
+	expressionTest{"not_there == null", true, true},
+	expressionTest{"servlet == null", false, true},
+	expressionTest{"servlet != null", true, true},
+
+	expressionTest{`Default(servlet, "unknown")`, "home", true},
+	expressionTest{`Default(referer, "unknown")`, "unknown", true},
+	expressionTest{`Default(not_there, "unknown")`, "unknown", true},
+	expressionTest{"Coalesce(not_there, referer, timing.total, servlet)", 612.5, true},
+	expressionTest{"Coalesce(not_there, referer)", nil, true},
+	expressionTest{"Coalesce(cached, true)", false, true},
+	// Arguments after the first one that's there aren't evaluated, so can't fail
+	expressionTest{"Coalesce(servlet, servlet + 1)", "home", true},
+}
+
+func TestNullFunctions(t *testing.T) {
+	event := `{"servlet": "home", "referer": null, "cached": false, "timing": {"total": 612.5}}`
+	checkExpressions(t, event, nullTests)
+}
+
+func TestIsNullAgreesWithEqualsNull(t *testing.T) {
+	data := map[string]interface{}{"servlet": "home", "referer": nil}
+	for _, field := range []string{"servlet", "referer", "not_there", "Lower(not_there)", "null"} {
+		isNull, err := Parse("IsNull(" + field + ")")
+		if err != nil {
+			t.Fatal(err)
+		}
+		equalsNull, err := Parse(field + " == null")
+		if err != nil {
+			t.Fatal(err)
+		}
+		result1, _ := isNull.Evaluate(data)
+		result2, _ := equalsNull.Evaluate(data)
+		if result1 != result2 {
+			t.Errorf("Expected IsNull(%s) and %s == null to agree, got %v and %v", field, field, result1, result2)
+		}
+	}
+}
+
+func TestNullFunctionSetupErrors(t *testing.T) {
+	for _, statement := range []string{"Exists(Lower(servlet))", "Exists(5)", "Exists(a, b)", "IsNull()", "Default(a)", "Default(a, b, c)", "Coalesce(a)"} {
+		if expr, err := Parse(statement); err == nil {
+			t.Errorf("Expected %s not to parse, got %v", statement, expr)
+		}
+	}
+}
+
+func TestQueryTellsMissingFromNull(t *testing.T) {
+	var data JSONData
+	if err := json.Unmarshal([]byte(`{"servlet": "home", "referer": null}`), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	q := NewScribeQuery([]interface{}{"servlet", "referer", "not_there", "Lower(not_there)", "Default(not_there, 1)"}, nil)
+	pairs, passes, err := q.Evaluate(data)
+	if err != nil || !passes {
+		t.Fatalf("Expected the event to pass, got %v (%v)", passes, err)
+	}
+	expected := []interface{}{
+		[]interface{}{"servlet", "home"},
+		[]interface{}{"referer", nil},
+		[]interface{}{"not_there"},
+		[]interface{}{"Lower(not_there)", nil},
+		[]interface{}{"Default(not_there,1)", 1},
+	}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, pairs)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"json"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Numbers come as ints, from literals like 10 and counts like Len(), or as float64s, from JSON and literals like
+ * 10.0. Everything that takes a number takes either, and 10 and 10.0 are the same number.
+ */
+func numberValue(value interface{}) (number float64, ok bool) {
+	switch value := value.(type) {
+	case int:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+// Whole, non-negative numbers, like sizes and positions, as ints.
+func countValue(value interface{}) (count int, ok bool) {
+	switch value := value.(type) {
+	case int:
+		return value, value >= 0
+	case float64:
+		return int(value), value >= 0 && value == float64(int(value))
+	}
+	return 0, false
+}
+
+var intArithmeticOperators = map[string](func(a, b int) int){
+	"Add":      func(a, b int) int { return a + b },
+	"Subtract": func(a, b int) int { return a - b },
+	"Multiply": func(a, b int) int { return a * b },
+}
+
+// Ints stay ints through Add, Subtract and Multiply. Dividing, or mixing in a float64, gives a float64.
+func arithmetic(fname string, a, b interface{}) (result interface{}, ok bool) {
+	int1, ok1 := a.(int)
+	int2, ok2 := b.(int)
+	if intOperator, isIntOperator := intArithmeticOperators[fname]; ok1 && ok2 && isIntOperator {
+		return intOperator(int1, int2), true
+	}
+
+	num1, ok1 := numberValue(a)
+	num2, ok2 := numberValue(b)
+	if !ok1 || !ok2 {
+		return nil, false
+	}
+	return arithmeticOperators[fname](num1, num2), true
+}
+
+// Numbers as they're usually written, so 200.0 from JSON is "200" rather than "2e+02".
+func formatNumber(number float64) string {
+	if number == math.Floor(number) && math.Fabs(number) < 1e15 {
+		return strconv.Itoa64(int64(number))
+	}
+	return strconv.Ftoa64(number, 'g', -1)
+}
+
+/*
+ * ToNumber(value) -> number, ToString(value) -> string, ToBool(value) -> bool
+ *
+ * ToNumber reads numbers from strings (e.g. "12.5"), and makes true 1 and false 0. ToString writes numbers as
+ * formatNumber does and objects and arrays as JSON. ToBool reads "true", "false", "1", "0" and the like from
+ * strings, and takes any number but 0 as true. A missing value stays missing, except ToBool makes it false, and
+ * a string that doesn't say a number or bool is an error.
+ */
+type Conversion struct {
+	expr  Expression
+	fname string
+}
+
+var conversions = map[string](func(value interface{}) (interface{}, os.Error)){
+	"ToNumber": toNumber,
+	"ToString": toString,
+	"ToBool":   toBool,
+}
+
+func (c *Conversion) Setup(fname string, args []Expression) (err os.Error) {
+	if _, ok := conversions[fname]; !ok {
+		return fmt.Errorf("%v is not a supported Conversion", fname)
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("%s expects a single argument, the value to convert", fname)
+	}
+	c.expr = args[0]
+	c.fname = fname
+	return nil
+}
+
+func (c *Conversion) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	value, err := c.expr.Evaluate(data)
+	if err != nil {
+		return nil, err
+	}
+	return conversions[c.fname](value)
+}
+
+func (c *Conversion) String() string {
+	return fmt.Sprintf("%s(%v)", c.fname, c.expr)
+}
+
+func toNumber(value interface{}) (result interface{}, err os.Error) {
+	switch value := value.(type) {
+	case nil, int, float64:
+		return value, nil
+	case bool:
+		if value {
+			return 1., nil
+		}
+		return 0., nil
+	case string:
+		number, err := strconv.Atof64(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("ToNumber can't read a number from %s", strconv.Quote(value))
+		}
+		return number, nil
+	}
+	return nil, fmt.Errorf("ToNumber can't make a number of a %T", value)
+}
+
+func toString(value interface{}) (result interface{}, err os.Error) {
+	switch value := value.(type) {
+	case nil, string:
+		return value, nil
+	case int:
+		return strconv.Itoa(value), nil
+	case float64:
+		return formatNumber(value), nil
+	case bool:
+		return fmt.Sprint(value), nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+func toBool(value interface{}) (result interface{}, err os.Error) {
+	switch value := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return value, nil
+	case int, float64:
+		number, _ := numberValue(value)
+		return number != 0, nil
+	case string:
+		result, err := strconv.Atob(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("ToBool can't read a bool from %s", strconv.Quote(value))
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("ToBool can't make a bool of a %T", value)
+}
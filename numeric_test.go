@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+var numericTests = []expressionTest{
+	// Literal ints and JSON float64s mix freely
+	expressionTest{"Add(timing.total, 1)", 613.5, true},
+	expressionTest{"timing.backend * 2", 400., true},
+	expressionTest{"status - 1", 199., true},
+	expressionTest{"1 + 2", 3, true},
+	expressionTest{"7 - 10", -3, true},
+	expressionTest{"6 * 7", 42, true},
+	expressionTest{"7 / 2", 3.5, true},
+	expressionTest{"1.5 + 1", 2.5, true},
+	expressionTest{"Len(servlet) + 1", 5, true},
+	expressionTest{"Len(servlet) * timing.total", 2450., true},
+	expressionTest{`Add(servlet, 1)`, nil, false},
+	expressionTest{`1 + true`, nil, false},
+
+	expressionTest{"status == 200.0", true, true},
+	expressionTest{"Len(servlet) == 4.0", true, true},
+
+	expressionTest{"ToNumber(count)", 12.5, true},
+	expressionTest{"ToNumber(status)", 200., true},
+	expressionTest{"ToNumber(7)", 7, true},
+	expressionTest{"ToNumber(cached)", 0., true},
+	expressionTest{"ToNumber(not_there)", nil, true},
+	expressionTest{"ToNumber(servlet)", nil, false},
+	expressionTest{"ToNumber(timing)", nil, false},
+	expressionTest{"ToNumber(count) > 10", true, true},
+
+	expressionTest{"ToString(status)", "200", true},
+	expressionTest{"ToString(timing.total)", "612.5", true},
+	expressionTest{"ToString(big)", "1e+20", true},
+	expressionTest{"ToString(7)", "7", true},
+	expressionTest{"ToString(cached)", "false", true},
+	expressionTest{"ToString(servlet)", "home", true},
+	expressionTest{"ToString(not_there)", nil, true},
+	expressionTest{"ToString(timing)", `{"backend":200,"total":612.5}`, true},
+	expressionTest{`Concat("status ", status)`, "status 200", true},
+
+	expressionTest{"ToBool(flag)", true, true},
+	expressionTest{"ToBool(cached)", false, true},
+	expressionTest{"ToBool(status)", true, true},
+	expressionTest{"ToBool(0)", false, true},
+	expressionTest{`ToBool("0")`, false, true},
+	expressionTest{"ToBool(not_there)", false, true},
+	expressionTest{"ToBool(servlet)", nil, false},
+}
+
+func TestNumericTyping(t *testing.T) {
+	event := `{"servlet": "home", "status": 200, "cached": false, "count": " 12.5", "flag": "true", "big": 1e20,
+		"timing": {"total": 612.5, "backend": 200}}`
+	checkExpressions(t, event, numericTests)
+}
+
+func TestWindowsTakeAnyNumbers(t *testing.T) {
+	expr, err := Parse("WindowAve(RollingWindow(value, 3.0))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ndx, value := range []interface{}{1., 2, 3., 4} {
+		average, err := expr.Evaluate(map[string]interface{}{"value": value})
+		if err != nil {
+			t.Fatalf("Event %d: %v", ndx, err)
+		}
+		if expected := []float64{1, 1.5, 2, 3}[ndx]; average != expected {
+			t.Errorf("Event %d: expected an average of %v, got %v", ndx, expected, average)
+		}
+	}
+
+	expr, err = Parse("WindowSum(TimedWindow(Len(uri), 60.0))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := expr.Evaluate(map[string]interface{}{"uri": "/biz"})
+	if err != nil || sum != 4. {
+		t.Errorf("Expected a window of lengths to sum to 4, got %v (%v)", sum, err)
+	}
+
+	expr, err = Parse("RollingWindow(value, 2.5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.Evaluate(map[string]interface{}{"value": 1.}); err == nil {
+		t.Errorf("Expected a window size of 2.5 to be an error")
+	}
+}
@@ -4,67 +4,254 @@ import (
 	"os"
 	"fmt"
 	"strconv"
-	"log"
-	"regexp"
 )
 
+// Splits a function call like Foo(Bar(a,b),c) into its name and the text of each of its arguments, "Bar(a,b)" and "c".
 func ParseString(statement string) (fname string, args []string, err os.Error) {
-	// Match a word followed by a pair of parens with anything in between them.
-	expressionReString := `[A-Z|a-z|0-9]+\((.+)\)`
-	expressionRe, err := regexp.Compile(expressionReString)
-	if !expressionRe.MatchString(statement) {
-		return "", []string{}, fmt.Errorf("\"%v\" is not an Expression", statement)
-	}
-	// Now pull out the functiona name.
-	fnameRe, err := regexp.Compile(`([A-Z|a-z|0-9]+)\((.+)\)$`)
-	fnameMatches := fnameRe.FindStringSubmatch(statement)
-	fname = fnameMatches[1]
-	argsStr := fnameMatches[2]
-
-	// Scan over the arguments text, keeping track of the level of parentheses
-	// nesting. If we reach a comma at the top-level, end the currentWord
-	// and add it to the list of arguments.
-	parenLevel := 0
-	quoted := false
-	currentWord := []int{}
-	for _, c := range argsStr {
-		switch c {
-		case '(':
-			parenLevel++
-			continue
-		case ')':
-			parenLevel--
-			continue
-		// We keep track of whether we're inside of quotes, so
-		// we know whether to ignore whitespace. The quotes are
-		// later stripped off in ParseLiteral().
-		case '"', '`', '\'':
-			quoted = !quoted
+	node, err := parseSyntax(statement)
+	if err != nil {
+		return "", []string{}, err
+	}
+	if node.kind != nodeCall {
+		return "", []string{}, fmt.Errorf("\"%v\" is not a function call", statement)
+	}
+	for _, arg := range node.args {
+		args = append(args, statement[arg.start:arg.end])
+	}
+	return node.token.text, args, nil
+}
+
+type nodeKind int
+
+const (
+	nodeLiteral nodeKind = iota
+	nodePath
+	nodeCall
+	nodeOperator // e.g. a + b, or not a
+)
+
+// A statement as written, before it's made into Expressions.
+type syntaxNode struct {
+	kind       nodeKind
+	token      token         // The function, GetDeep path or operator name, or the literal
+	value      interface{}   // Of literals
+	args       []*syntaxNode // Of calls, or the operands of operators
+	start, end int           // Where the node is in the statement, in bytes
+}
+
+/*
+ * Recursive-descent parser for the grammar
+ *
+ *   expression := and {'or' and}
+ *   and        := not {'and' not}
+ *   not        := 'not' not | comparison
+ *   comparison := sum [('==' | '!=' | '<' | '<=' | '>' | '>=') sum]
+ *   sum        := product {('+' | '-') product}
+ *   product    := negation {('*' | '/') negation}
+ *   negation   := '-' negation | primary
+ *   primary    := '(' expression ')' | name '(' [expression {',' expression}] ')' | name | number | string | 'true' | 'false' | 'null'
+ *
+ * where a name on its own is a GetDeep path.
+ */
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Names that can't be GetDeep paths. Fields called these can still be had with GetDeep("and").
+var keywords = map[string]bool{"and": true, "or": true, "not": true, "true": true, "false": true, "null": true}
+
+func parseSyntax(statement string) (node *syntaxNode, err os.Error) {
+	tokens, err := lex(statement)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	if node, err = p.parseExpression(); err != nil {
+		return nil, err
+	}
+	if tok := p.next(); tok.kind != tokenEnd {
+		return nil, p.errorAt(tok, "expected the end of the statement, found %v", tok)
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// Lexing always leaves a tokenEnd last, which we stay at once we get there.
+func (p *parser) next() (tok token) {
+	tok = p.tokens[p.pos]
+	if tok.kind != tokenEnd {
+		p.pos++
+	}
+	return tok
+}
+
+// Whether the next token is one of these operators or keywords.
+func (p *parser) peekOperator(operators ...string) bool {
+	tok := p.peek()
+	if tok.kind != tokenOperator && tok.kind != tokenName {
+		return false
+	}
+	for _, operator := range operators {
+		if tok.text == operator {
+			return true
 		}
+	}
+	return false
+}
+
+func (p *parser) errorAt(tok token, format string, args ...interface{}) os.Error {
+	return &ParseError{tok.column, fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseExpression() (node *syntaxNode, err os.Error) {
+	return p.parseBinary(p.parseAnd, "or")
+}
 
-		if c == ' ' && !quoted {
-			continue
+func (p *parser) parseAnd() (node *syntaxNode, err os.Error) {
+	return p.parseBinary(p.parseNot, "and")
+}
+
+func (p *parser) parseNot() (node *syntaxNode, err os.Error) {
+	if p.peekOperator("not") {
+		return p.parseUnary(p.parseNot)
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node *syntaxNode, err os.Error) {
+	comparisons := []string{"==", "!=", "<", "<=", ">", ">="}
+	if node, err = p.parseSum(); err != nil {
+		return nil, err
+	}
+	if !p.peekOperator(comparisons...) {
+		return node, nil
+	}
+	operator := p.next()
+	right, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.peekOperator(comparisons...) {
+		return nil, p.errorAt(p.peek(), "comparisons can't be chained, join them with and")
+	}
+	return operatorNode(operator, node, right), nil
+}
+
+func (p *parser) parseSum() (node *syntaxNode, err os.Error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *parser) parseProduct() (node *syntaxNode, err os.Error) {
+	return p.parseBinary(p.parseNegation, "*", "/")
+}
+
+func (p *parser) parseNegation() (node *syntaxNode, err os.Error) {
+	if p.peekOperator("-") {
+		return p.parseUnary(p.parseNegation)
+	}
+	return p.parsePrimary()
+}
+
+// Parses operands joined by any of these operators, left to right, so a - b + c is (a - b) + c.
+func (p *parser) parseBinary(parseOperand func() (*syntaxNode, os.Error), operators ...string) (node *syntaxNode, err os.Error) {
+	if node, err = parseOperand(); err != nil {
+		return nil, err
+	}
+	for p.peekOperator(operators...) {
+		operator := p.next()
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
 		}
+		node = operatorNode(operator, node, right)
+	}
+	return node, nil
+}
 
-		if parenLevel == 0 && !quoted && c == ',' {
-			args = append(args, string(currentWord))
-			currentWord = []int{}
-		} else {
-			currentWord = append(currentWord, c)
+func (p *parser) parseUnary(parseOperand func() (*syntaxNode, os.Error)) (node *syntaxNode, err os.Error) {
+	operator := p.next()
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	node = operatorNode(operator, operand)
+	node.start = operator.offset
+	return node, nil
+}
+
+func operatorNode(operator token, operands ...*syntaxNode) *syntaxNode {
+	return &syntaxNode{kind: nodeOperator, token: operator, args: operands, start: operands[0].start, end: operands[len(operands)-1].end}
+}
+
+func (p *parser) parsePrimary() (node *syntaxNode, err os.Error) {
+	tok := p.next()
+	node = &syntaxNode{token: tok, value: tok.value, start: tok.offset, end: tok.end()}
+	switch {
+	case tok.kind == tokenNumber || tok.kind == tokenString:
+		node.kind = nodeLiteral
+		return node, nil
+	case tok.kind == tokenName && (tok.text == "true" || tok.text == "false"):
+		node.kind = nodeLiteral
+		node.value = tok.text == "true"
+		return node, nil
+	case tok.kind == tokenName && tok.text == "null":
+		node.kind = nodeLiteral
+		node.value = nil
+		return node, nil
+	case tok.kind == tokenName && !keywords[tok.text]:
+		if p.peek().kind != tokenLeftParen {
+			node.kind = nodePath
+			return node, nil
 		}
+		p.next()
+		node.kind = nodeCall
+		return node, p.parseArgs(node)
+	case tok.kind == tokenLeftParen:
+		if node, err = p.parseExpression(); err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing.kind != tokenRightParen {
+			return nil, p.errorAt(closing, "expected ) to close the ( at column %d, found %v", tok.column, closing)
+		}
+		node.start, node.end = tok.offset, closing.end()
+		return node, nil
 	}
-	// Don't forget to add the last word.
-	args = append(args, string(currentWord))
+	return nil, p.errorAt(tok, "expected a function, field or literal, found %v", tok)
+}
 
-	if parenLevel != 0 {
-		return "", []string{}, fmt.Errorf("Unbalanced parentheses in \"%v\"", argsStr)
+// Parses the arguments of a call, up to and including its closing paren.
+func (p *parser) parseArgs(call *syntaxNode) (err os.Error) {
+	if tok := p.peek(); tok.kind == tokenRightParen {
+		call.end = p.next().end()
+		return nil
 	}
-	if quoted {
-		return "", []string{}, fmt.Errorf("Unbalanced quote marks in \"%v\"", argsStr)
+	for {
+		arg, err := p.parseExpression()
+		if err != nil {
+			return err
+		}
+		call.args = append(call.args, arg)
+
+		switch tok := p.next(); tok.kind {
+		case tokenComma:
+		case tokenRightParen:
+			call.end = tok.end()
+			return nil
+		case tokenEnd:
+			return p.errorAt(tok, "missing ) to close %s(", call.token.text)
+		default:
+			return p.errorAt(tok, "expected , or ) after argument %d of %s, found %v", len(call.args), call.token.text, tok)
+		}
 	}
-	return fname, args, nil
+	return
 }
 
+
 type Expression interface {
 	Setup(fname string, args []Expression) (err os.Error)
 	Evaluate(data JSONData) (result interface{}, err os.Error)
@@ -89,6 +276,9 @@ func (l *Literal) Setup(fname string, args []Expression) (err os.Error) {
 }
 
 func (l *Literal) String() string {
+	if l.value == nil {
+		return "null"
+	}
 	return fmt.Sprintf("%v", l.value)
 }
 
@@ -109,34 +299,98 @@ func ParseLiteral(literal string) (l *Literal, err os.Error) {
 
 
 func Parse(statement string) (expr Expression, err os.Error) {
-	// First try to parse literals
-	if expr, err = ParseLiteral(statement); err == nil {
-		return
-	}
-
-	// Base case: statement is a single expression (e.g. Foo(a,b))
-	fname, args, err := ParseString(statement)
+	expr, _, err = parseWithWindows(statement)
+	return expr, err
+}
 
-	// Then treat it as a GetDeep expression if it's not an expression
+// Parses a statement, also handing back the TimedWindows in it, so their late events can be counted.
+func parseWithWindows(statement string) (expr Expression, windows []*TimedWindow, err os.Error) {
+	node, err := parseSyntax(statement)
 	if err != nil {
-		expr, err := NewGetDeepExpression(statement)
-		if err == nil {
-			log.Printf("found a get deep expr: %v, args: %v", expr, args)
-			return expr, err
-		}
-		log.Printf("couldn't parse get deep expr: ", err)
+		return nil, nil, err
+	}
+	expr, err = compile(node, &windows)
+	return expr, windows, err
+}
+
+// Makes the Expression tree for a parsed statement, adding any TimedWindows made to windows.
+func compile(node *syntaxNode, windows *[]*TimedWindow) (expr Expression, err os.Error) {
+	switch node.kind {
+	case nodeLiteral:
+		return &Literal{node.value}, nil
+	case nodePath:
+		return NewGetDeepExpression(node.token.text)
 	}
 
-	// Now start parsing the rest
 	expressionArgs := []Expression{}
-	for _, arg := range args {
-		argExpr, err := Parse(arg)
+	for _, arg := range node.args {
+		argExpr, err := compile(arg, windows)
 		if err != nil {
 			return nil, err
 		}
 		expressionArgs = append(expressionArgs, argExpr)
 	}
 
+	fname := node.token.text
+	switch {
+	case node.kind == nodeCall:
+		expr = newFunction(fname)
+	case fname == "-" && len(expressionArgs) == 1:
+		if negated, ok := negateLiteral(expressionArgs[0]); ok {
+			return negated, nil
+		}
+		fname, expressionArgs = "Subtract", []Expression{&Literal{0.}, expressionArgs[0]}
+		expr = new(ArithmeticOperator)
+	default:
+		fname = infixOperators[fname]
+		expr = newFunction(fname)
+	}
+	if expr == nil {
+		return nil, &ParseError{node.token.column, fmt.Sprintf("unrecognized function name '%s'", fname)}
+	}
+	if err = expr.Setup(fname, expressionArgs); err != nil {
+		return nil, &ParseError{node.token.column, err.String()}
+	}
+	if window, ok := expr.(*TimedWindow); ok {
+		*windows = append(*windows, window)
+	}
+	return expr, nil
+}
+
+// Numbers written with a minus are just negative numbers, not arithmetic.
+func negateLiteral(expr Expression) (negated *Literal, ok bool) {
+	literal, ok := expr.(*Literal)
+	if !ok {
+		return nil, false
+	}
+	switch value := literal.value.(type) {
+	case int:
+		return &Literal{-value}, true
+	case float64:
+		return &Literal{-value}, true
+	}
+	return nil, false
+}
+
+// The operators a statement can use in between (or before) its operands, and the functions they stand for.
+var infixOperators = map[string]string{
+	"+":   "Add",
+	"-":   "Subtract",
+	"*":   "Multiply",
+	"/":   "Divide",
+	"==":  "Eq",
+	"!=":  "Ne",
+	"<":   "Lt",
+	"<=":  "Le",
+	">":   "Gt",
+	">=":  "Ge",
+	"and": "And",
+	"or":  "Or",
+	"not": "Not",
+}
+
+// A new, not yet set up, Expression for the function of this name, or nil if there's no such function.
+func newFunction(fname string) (expr Expression) {
 	switch {
 	case fname == "RandomSample":
 		expr = new(RandomSample)
@@ -146,18 +400,52 @@ func Parse(statement string) (expr Expression, err os.Error) {
 		expr = new(GetDeepExpression)
 	case fname == "Subtract" || fname == "Add" || fname == "Divide" || fname == "Multiply":
 		expr = new(ArithmeticOperator)
+	case fname == "Eq" || fname == "Ne" || fname == "Lt" || fname == "Le" || fname == "Gt" || fname == "Ge":
+		expr = new(ComparisonOperator)
+	case fname == "And" || fname == "Or" || fname == "Not":
+		expr = new(BooleanOperator)
+	case fname == "If":
+		expr = new(IfExpression)
+	case fname == "Contains" || fname == "StartsWith" || fname == "EndsWith":
+		expr = new(StringPredicate)
+	case fname == "Lower" || fname == "Upper" || fname == "Trim":
+		expr = new(StringTransform)
+	case fname == "Substr":
+		expr = new(Substr)
+	case fname == "Split":
+		expr = new(Split)
+	case fname == "Concat":
+		expr = new(Concat)
+	case fname == "Len":
+		expr = new(Len)
+	case fname == "Replace":
+		expr = new(Replace)
+	case fname == "Matches":
+		expr = new(Matches)
+	case fname == "Extract":
+		expr = new(Extract)
+	case fname == "RegexReplace":
+		expr = new(RegexReplace)
+	case fname == "ToNumber" || fname == "ToString" || fname == "ToBool":
+		expr = new(Conversion)
+	case fname == "Exists":
+		expr = new(Exists)
+	case fname == "IsNull":
+		expr = new(IsNull)
+	case fname == "Coalesce" || fname == "Default":
+		expr = new(Coalesce)
 	case fname == "RollingWindow":
 		expr = new(RollingWindow)
 	case fname == "TimedWindow":
 		expr = new(TimedWindow)
+	case fname == "EventTime":
+		expr = new(EventTime)
 	case fname == "WindowAve":
 		expr = new(WindowAve)
+	case fname == "WindowSum":
+		expr = new(WindowSum)
 	case fname == "As":
 		expr = new(AsClause)
-
-	default:
-		return nil, fmt.Errorf("Unrecognized function name '%s'", fname)
 	}
-	err = expr.Setup(fname, expressionArgs)
 	return
 }
@@ -2,8 +2,11 @@ package main
 
 import (
 	"testing"
+	"json"
 	"fmt"
 	"os"
+	"reflect"
+	"strings"
 )
 
 type parseStringTest struct {
@@ -23,6 +26,8 @@ var parseStringTests = []parseStringTest{
 	parseStringTest{"Foo(Bar(a,b),c,de)", "Foo", []string{"Bar(a,b)", "c", "de"}, true},
 	parseStringTest{"Foo(a,Bar(b,c)", "", []string{}, false}, // Unbalanced parens
 	parseStringTest{"foo", "", []string{}, false},
+	parseStringTest{"Foo((a + b) * 2, c > 1)", "Foo", []string{"(a + b) * 2", "c > 1"}, true},
+	parseStringTest{"a + Foo(b)", "", []string{}, false},
 }
 
 func TestParseFunction(t *testing.T) {
@@ -56,3 +61,217 @@ func sliceEquals(x, y []string) (ok bool, err os.Error) {
 	}
 	return true, nil
 }
+
+type parseTest struct {
+	statement string
+	expected  string // String() of the expression
+}
+
+var parseTests = []parseTest{
+	parseTest{"timing.total", "timing.total"},
+	parseTest{"  timing.total ", "timing.total"},
+	parseTest{"42", "42"},
+	parseTest{"-2.5", "-2.5"},
+	parseTest{`"home"`, "home"},
+	parseTest{"GetDeep('a.b')", "a.b"},
+	parseTest{"WindowAve( TimedWindow(timing.total, 60) )", "WindowAve(TimedWindow(timing.total,60))"},
+	parseTest{`TimedWindow(timing.total, 60, EventTime("start_time", 10))`, "TimedWindow(timing.total,60,EventTime(start_time,10))"},
+	parseTest{"Subtract( b , a )", "Subtract(b,a)"},
+	parseTest{"a + b * c - d", "Subtract(Add(a,Multiply(b,c)),d)"},
+	parseTest{"(a + b) * c", "Multiply(Add(a,b),c)"},
+	parseTest{"a - -b", "Subtract(a,Subtract(0,b))"},
+	parseTest{"a + 1 >= b * 2", "Add(a,1) >= Multiply(b,2)"},
+	parseTest{"Eq(a, b)", "a == b"},
+	parseTest{"not a == b or c and d", "(not (a == b)) or (c and d)"},
+	parseTest{"not (a or b)", "not (a or b)"},
+	parseTest{`timing.total > 500 and servlet == "home"`, "(timing.total > 500) and (servlet == home)"},
+}
+
+func TestParse(t *testing.T) {
+	for _, test := range parseTests {
+		expr, err := Parse(test.statement)
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %v", test.statement, err)
+			continue
+		}
+		if expr.String() != test.expected {
+			t.Errorf("Expected %s to parse to %s, got %s", test.statement, test.expected, expr)
+		}
+	}
+}
+
+type parseErrorTest struct {
+	statement string
+	column    int
+}
+
+var parseErrorTests = []parseErrorTest{
+	parseErrorTest{"Foo(a", 6},
+	parseErrorTest{"WindowAve(a,GetDeep(b)", 23},
+	parseErrorTest{"timing total", 8},
+	parseErrorTest{"Add(,a)", 5},
+	parseErrorTest{"Add(a b)", 7},
+	parseErrorTest{"a,b", 2},
+	parseErrorTest{`GetDeep("abc)`, 9},
+	parseErrorTest{`GetDeep("a\qb")`, 11},
+	parseErrorTest{"GetDeep(a))", 11},
+	parseErrorTest{"Nope(a)", 1},
+	parseErrorTest{"Add(1, RollingWindow(a))", 8},
+	parseErrorTest{"servlet = home", 9},
+	parseErrorTest{"!ok", 1},
+	parseErrorTest{"a < b < c", 7},
+	parseErrorTest{"(a + b", 7},
+	parseErrorTest{"a and or b", 7},
+	parseErrorTest{"timing.total >", 15},
+	parseErrorTest{"Add(a, b) and not", 18},
+	parseErrorTest{"headers.X-Forwarded-For", 10},
+	parseErrorTest{"Lower(user-agent)", 11},
+	parseErrorTest{"@timestamp > 0", 1},
+	parseErrorTest{"", 1},
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range parseErrorTests {
+		expr, err := Parse(test.statement)
+		if err == nil {
+			t.Errorf("Expected an error parsing %s, got %v", test.statement, expr)
+			continue
+		}
+		parseErr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %s, got %T %v", test.statement, err, err)
+			continue
+		}
+		if parseErr.Column != test.column {
+			t.Errorf("Expected the error in %s at column %d, got %v", test.statement, test.column, err)
+		}
+	}
+}
+
+func TestParseFieldsWithOperatorsInTheirNames(t *testing.T) {
+	_, err := Parse("headers.X-Forwarded-For")
+	if err == nil || strings.Index(err.String(), `GetDeep("headers.X-Forwarded-For")`) < 0 {
+		t.Errorf("Expected an error pointing at GetDeep, got %v", err)
+	}
+
+	data := map[string]interface{}{
+		"@timestamp": 1.5,
+		"headers":    map[string]interface{}{"X-Forwarded-For": "10.0.0.1"},
+		"a":          3.,
+		"b":          1.,
+	}
+	for statement, expected := range map[string]interface{}{
+		`GetDeep("headers.X-Forwarded-For")`: "10.0.0.1",
+		`GetDeep("@timestamp")`:              1.5,
+		"a - b":                              2.,
+		"a -b":                               2.,
+		"a-1":                                2.,
+	} {
+		expr, err := Parse(statement)
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %v", statement, err)
+			continue
+		}
+		if value, _ := expr.Evaluate(data); value != expected {
+			t.Errorf("Expected %s to be %v, got %v", statement, expected, value)
+		}
+	}
+}
+
+func TestParseEscapedQuotes(t *testing.T) {
+	statements := map[string]string{
+		`"say \"hi\""`:      `say "hi"`,
+		`'don\'t'`:          "don't",
+		"`back\\`quote`":    "back`quote",
+		`"it's"`:            "it's",
+		`"tab\tand\\slash"`: "tab\tand\\slash",
+	}
+	for statement, expected := range statements {
+		expr, err := Parse(statement)
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %v", statement, err)
+			continue
+		}
+		if value, _ := expr.Evaluate(nil); value != expected {
+			t.Errorf("Expected %s to be %q, got %q", statement, expected, value)
+		}
+	}
+}
+
+// A statement, what it should evaluate to against the test event, and whether it should evaluate without an error.
+type expressionTest struct {
+	statement string
+	expected  interface{}
+	ok        bool
+}
+
+// Parses and evaluates each test's statement against event, a JSON object.
+func checkExpressions(t *testing.T, event string, tests []expressionTest) {
+	var data JSONData
+	if err := json.Unmarshal([]byte(event), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.statement)
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %v", test.statement, err)
+			continue
+		}
+		result, err := expr.Evaluate(data)
+		if test.ok && err != nil {
+			t.Errorf("Expected %s to evaluate, got %v", test.statement, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("Expected an error evaluating %s, got %v", test.statement, result)
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("Expected %s to be %#v, got %#v", test.statement, test.expected, result)
+		}
+	}
+}
+
+var infixTests = []expressionTest{
+	expressionTest{"timing.total - timing.backend * 2.0", 212.5, true},
+	expressionTest{"(timing.total - timing.backend) / 2.0", 206.25, true},
+	expressionTest{"-timing.backend", -200., true},
+	expressionTest{"servlet * 2", nil, false},
+	expressionTest{"timing.total >= 612.5", true, true},
+	expressionTest{"timing.total < 612.5", false, true},
+	expressionTest{"timing.total <= 612.5", true, true},
+	expressionTest{"timing.total - timing.backend > 400", true, true},
+	expressionTest{"cached == false", true, true},
+	expressionTest{"not_there == false", false, true},
+	expressionTest{`servlet == 200`, nil, false},
+	expressionTest{`"500" == 500`, nil, false},
+	expressionTest{`servlet > "a"`, true, true},
+	expressionTest{"servlet > 5", nil, false},
+	expressionTest{"timing == timing", nil, false},
+	expressionTest{`timing.total > 500 and servlet == "home"`, true, true},
+	expressionTest{`timing.total > 500 and servlet == "biz"`, false, true},
+	expressionTest{`servlet == "biz" or servlet == "home"`, true, true},
+	expressionTest{`not (servlet != "home")`, true, true},
+	expressionTest{"timing.total == 612.5 and status == 200", true, true},
+	expressionTest{"servlet and true", nil, false},
+	expressionTest{"not timing.total", nil, false},
+
+	// Short-circuiting means the bad side is never looked at
+	expressionTest{"false and servlet", false, true},
+	expressionTest{"true or servlet", true, true},
+}
+
+func TestInfixOperators(t *testing.T) {
+	checkExpressions(t, `{"servlet": "home", "status": 200, "cached": false, "timing": {"total": 612.5, "backend": 200}}`, infixTests)
+}
+
+// A bare word is always a field path, never a string, so servlet == home compares two fields.
+var bareWordTests = []expressionTest{
+	expressionTest{"servlet == home", false, true},
+	expressionTest{`servlet == "home"`, true, true},
+	expressionTest{"servlet == page", true, true},
+	expressionTest{"servlet != nowhere", true, true},
+}
+
+func TestBareWordsAreFields(t *testing.T) {
+	checkExpressions(t, `{"servlet": "home", "home": "biz", "page": "home"}`, bareWordTests)
+}
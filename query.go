@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// The fields and filters a client asked for, ready to evaluate against each event.
+type ScribeQuery struct {
+	displayFields    []Expression
+	filterPredicates []Expression
+	windows          []*TimedWindow // In the fields and filters, so their late events can be reported
+}
+
+// Builds a query from the "fields" and "filters" of a client's request. Expressions that don't parse are logged and skipped.
+func NewScribeQuery(fields []interface{}, filters []interface{}) *ScribeQuery {
+	q := new(ScribeQuery)
+
+	for _, fieldValue := range fields {
+		aggregator, windows, err := parseWithWindows(fieldValue.(string))
+		if err != nil {
+			log.Printf("Couldn't parse expression %v: %v", fieldValue, err)
+		} else {
+			q.displayFields = append(q.displayFields, aggregator)
+			q.windows = append(q.windows, windows...)
+			log.Printf("Parsed to aggregator: %v", aggregator.String())
+		}
+	}
+
+	for _, statement := range filters {
+		log.Printf("Statement: ", statement)
+		expr, windows, err := parseWithWindows(statement.(string))
+		if err != nil {
+			log.Printf("Couldn't parse statement \"%s\": %v", statement, err)
+		} else {
+			q.filterPredicates = append(q.filterPredicates, expr)
+			q.windows = append(q.windows, windows...)
+		}
+	}
+	return q
+}
+
+// Runs an event through the filters, and if it passes evaluates the display fields into [name, value] pairs, or
+// just [name] for fields missing from the event.
+// An error means the filters can't be evaluated at all.
+func (q *ScribeQuery) Evaluate(data JSONData) (outputPairs []interface{}, passes bool, err os.Error) {
+	passes, err = PassesAllFilters(data, q.filterPredicates)
+	if !passes {
+		return nil, false, err
+	}
+
+	outputPairs = make([]interface{}, 0, len(q.displayFields))
+	for _, fieldValue := range q.displayFields {
+		result, present, err := lookup(fieldValue, data)
+		if err != nil {
+			log.Printf("Got error '%v' evaluating field '%v'", err, fieldValue)
+		}
+		name := fieldValue.String()
+
+		// A field that isn't in the event at all is just its name, so it can be told apart from a null one
+		if !present {
+			outputPairs = append(outputPairs, []interface{}{name})
+			continue
+		}
+		outputPairs = append(outputPairs, []interface{}{name, result})
+	}
+	return outputPairs, true, nil
+}
+
+// Returns how many events the query's TimedWindows left out for being too late since the last call.
+func (q *ScribeQuery) TakeLate() (late int64) {
+	for _, window := range q.windows {
+		late += window.TakeLate()
+	}
+	return late
+}
@@ -12,6 +12,7 @@ import (
 	"flag"
 	"json"
 	"strings"
+	"time"
 )
 
 // To enable profiling:
@@ -22,14 +23,10 @@ type LineReader interface {
 }
 
 var (
-	streamHost    string
-	scribeStreams map[string]*DataStream
+	defaultSource Source
+	scribeStreams = newStreamRegistry()
 )
 
-func init() {
-	scribeStreams = make(map[string]*DataStream)
-}
-
 func CreateTestDataStream(fileName string) io.Reader {
 	file, err := os.Open(fileName)
 	if err != nil {
@@ -68,11 +65,8 @@ func serveTCP(conn net.Conn) {
 	ServeStream(jsonStream)
 }
 
-// type ScribeQuery struct {
-// 	fields []string
-// 	filters []string
-//  logName string
-// }
+// How often clients hear about the health of their streams, and data dropped because they weren't keeping up, in nanoseconds.
+const reportInterval = 2e9
 
 func ServeStream(stream *JSONConn) {
 	// Get our query from the client
@@ -86,64 +80,200 @@ func ServeStream(stream *JSONConn) {
 	logName := query.(map[string]interface{})["logName"].(string)
 	log.Printf("Subscribing to log", logName)
 
-	scribeStream := StreamByName(logName)
-
-	// Create a new channel to receive data on
-	dataChan := make(chan JSONData, 16)
-	request := new(SubscribeRequest)
-	request.dataChan = dataChan
-	scribeStream.subscribeChan <- request
+	// A query may merge the log from several scribe environments ({"envs": ["stagea", "prod"]}),
+	// or name a source of its own, but not both. Otherwise we use the default source.
+	format, _ := query.(map[string]interface{})["format"].(string)
+	envs, _ := query.(map[string]interface{})["envs"].([]interface{})
+	sourceURL, _ := query.(map[string]interface{})["source"].(string)
+	if len(envs) > 0 && sourceURL != "" {
+		log.Printf("Query for %s names both envs and a source, it can only have one", logName)
+		return
+	}
+	logStreams := []*DataStream{}
+	origins := []string{}
+	defer func() {
+		for _, logStream := range logStreams {
+			ReleaseStream(logStream)
+		}
+	}()
+	if len(envs) > 0 {
+		for _, env := range envs {
+			envName, _ := env.(string)
+			source, err := EnvSource(envName)
+			if err != nil {
+				log.Printf("Bad environment for %s: %v", logName, err)
+				return
+			}
+			logStream, err := StreamBySource(logName, source, format)
+			if err != nil {
+				log.Printf("Couldn't stream %s: %v", logName, err)
+				return
+			}
+			logStreams = append(logStreams, logStream)
+			origins = append(origins, envName)
+		}
+	} else {
+		source, streamFormat, err := clientSource(logName, sourceURL, format)
+		if err != nil {
+			log.Printf("Bad source for %s: %v", logName, err)
+			return
+		}
+		logStream, err := StreamBySource(logName, source, streamFormat)
+		if err != nil {
+			log.Printf("Couldn't stream %s: %v", logName, err)
+			return
+		}
+		logStreams = append(logStreams, logStream)
+		origins = append(origins, "")
+	}
 
-	defer func() { scribeStream.unsubscribeChan <- request }()
+	// Queries can also start ({"record": {"maxAge": "1h"}}) or stop ({"record": false}) recording the stream.
+	if recordOptions, ok := query.(map[string]interface{})["record"]; ok {
+		for _, scribeStream := range logStreams {
+			err = recordFromQuery(scribeStream, recordOptions)
+			if err != nil {
+				log.Printf("Failed to record %s: %v", logName, err)
+			}
+		}
+	}
 
-	displayFields := []Expression{}
-	for _, fieldValue := range query.(map[string]interface{})["fields"].([]interface{}) {
-		aggregator, err := Parse(fieldValue.(string))
+	// How to cope if we can't keep up, e.g. {"backpressure": "block", "blockTimeout": "250ms"}
+	policy, _ := query.(map[string]interface{})["backpressure"].(string)
+	var blockTimeout int64
+	if timeout, ok := query.(map[string]interface{})["blockTimeout"].(string); ok {
+		blockTimeout, err = ParseDuration(timeout)
 		if err != nil {
-			log.Printf("Couldn't parse expression %v: %v", fieldValue, err)
-		} else {
-			displayFields = append(displayFields, aggregator)
-			log.Printf("Parsed to aggregator: %v", aggregator.String())
+			log.Printf("Bad blockTimeout for %s: %v", logName, err)
+			return
 		}
 	}
 
-	filterPredicates := []Expression{}
-	for _, statement := range query.(map[string]interface{})["filters"].([]interface{}) {
-		log.Printf("Statement: ", statement)
-		expr, err := Parse(statement.(string))
+	// Create a new channel to receive data on, shared by all the streams we're merging
+	request, err := NewSubscribeRequest(16, policy, blockTimeout)
+	if err != nil {
+		log.Printf("Couldn't subscribe to %s: %v", logName, err)
+		return
+	}
+	dataChan, statusChan := request.dataChan, request.statusChan
+
+	// Queries can start with the recent past, e.g. {"backfill": "5m"}
+	if backfill, ok := query.(map[string]interface{})["backfill"].(string); ok {
+		backfillNs, err := ParseDuration(backfill)
 		if err != nil {
-			log.Printf("Couldn't parse statement \"%s\": %v", statement, err)
-		} else {
-			filterPredicates = append(filterPredicates, expr)
+			log.Printf("Bad backfill for %s: %v", logName, err)
+			return
 		}
+		request.SetBackfill(backfillNs, len(logStreams))
 	}
 
-	for {
-		data := <-dataChan
+	requests := []*SubscribeRequest{}
+	for ndx, scribeStream := range logStreams {
+		streamRequest := request.Sibling(origins[ndx])
+		scribeStream.Subscribe(streamRequest)
+		requests = append(requests, streamRequest)
+	}
 
-		if passes, err := PassesAllFilters(data, filterPredicates); !passes {
-			if err != nil {
-				log.Printf("Got error evaluating predicates: %v", err)
-				// We have to quit here because if we have an error where our filters always fail like this
-				// we would be stuck in a endless loop and never close the connection out.
-				break
+	defer func() {
+		for ndx, scribeStream := range logStreams {
+			scribeStream.Unsubscribe(requests[ndx])
+		}
+	}()
+
+	scribeQuery := NewScribeQuery(query.(map[string]interface{})["fields"].([]interface{}), query.(map[string]interface{})["filters"].([]interface{}))
+
+	// Evaluates an event and sends the client the result. Returns false once we should give up on the client.
+	var evaluated, matched int64
+	handleData := func(data JSONData) bool {
+		evaluated++
+		outputPairs, passes, err := scribeQuery.Evaluate(data)
+		if err != nil {
+			log.Printf("Got error evaluating predicates: %v", err)
+			// We have to quit here because if we have an error where our filters always fail like this
+			// we would be stuck in a endless loop and never close the connection out.
+			return false
+		}
+		if !passes {
+			return true
+		}
+		matched++
+
+		err = stream.WriteJSON(outputPairs)
+		if err != nil {
+			log.Printf("Failed to write", err)
+			return false
+		}
+		return true
+	}
+
+	// Start off with any history the client asked for, before moving on to live data.
+	if request.backlogChan != nil {
+		histories := [][]HistoryEvent{}
+		for _ = range requests {
+			histories = append(histories, <-request.backlogChan)
+		}
+		for _, event := range mergeHistories(histories) {
+			if !handleData(event.Data) {
+				return
 			}
 		}
-		outputPairs := make([]interface{}, 0)
+	}
+
+	// Let the client know periodically how the streams are doing, so it can tell "no matches" from "no data",
+	// and if we've had to drop anything, so it knows its numbers are off.
+	reportTicker := time.NewTicker(reportInterval)
+	defer reportTicker.Stop()
+	var totalDropped, totalLate int64
 
-		for _, fieldValue := range displayFields {
-			result, err := fieldValue.Evaluate(data)
+	for {
+		var data JSONData
+		select {
+		case status := <-statusChan:
+			err := stream.WriteJSON(status.ControlFrame())
 			if err != nil {
-				log.Printf("Got error '%v' evaluating field '%v'", err, fieldValue)
+				log.Printf("Failed to write", err)
+				return
+			}
+			continue
+		case <-reportTicker.C:
+			health := []interface{}{}
+			for _, logStream := range logStreams {
+				health = append(health, logStream.Health())
+			}
+			err := stream.WriteJSON(map[string]interface{}{"control": "health", "streams": health, "evaluated": evaluated, "matched": matched})
+			if err != nil {
+				log.Printf("Failed to write", err)
+				return
+			}
+			evaluated, matched = 0, 0
+
+			var dropped int64
+			for _, streamRequest := range requests {
+				dropped += streamRequest.TakeDropped()
+			}
+			if dropped > 0 {
+				totalDropped += dropped
+				err = stream.WriteJSON(map[string]interface{}{"control": "drops", "dropped": dropped, "total": totalDropped})
+				if err != nil {
+					log.Printf("Failed to write", err)
+					return
+				}
+			}
+
+			// Events an EventTime window left out for being too late are off the numbers the same way
+			if late := scribeQuery.TakeLate(); late > 0 {
+				totalLate += late
+				err = stream.WriteJSON(map[string]interface{}{"control": "late", "late": late, "total": totalLate})
+				if err != nil {
+					log.Printf("Failed to write", err)
+					return
+				}
 			}
-			name := fieldValue.String()
-			outputPairs = append(outputPairs, []interface{}{name, result})
+			continue
+		case data = <-dataChan:
 		}
 
-		err := stream.WriteJSON(outputPairs)
-		if err != nil {
-			log.Printf("Failed to write", err)
-			break
+		if !handleData(data) {
+			return
 		}
 	}
 }
@@ -170,11 +300,21 @@ func ServeDataItemPage(writer http.ResponseWriter, request *http.Request) {
 		writer.Header().Set("Content-Type", "text/plain")
 	}
 
-	stream := StreamByName("ranger")
+	// Links from before lookups took a stream are all for ranger
+	streamName := request.FormValue("stream")
+	if streamName == "" {
+		streamName = "ranger"
+	}
 
-	log.Printf("Serving full data for '%s'", request.FormValue("q"))
-	data := stream.LookupData(request.FormValue("q"))
-	if data == nil {
+	log.Printf("Serving full data for '%s' from %s", request.FormValue("q"), streamName)
+	var data JSONData
+	found := false
+	for _, stream := range FindStreams(streamName) {
+		if data, found = stream.LookupData(request.FormValue("q")); found {
+			break
+		}
+	}
+	if !found {
 		log.Printf("Failed to find %s", request.FormValue("q"))
 		writer.WriteHeader(http.StatusNotFound)
 		return
@@ -190,24 +330,95 @@ func ServeDataItemPage(writer http.ResponseWriter, request *http.Request) {
 	writer.Write(outputBytes)
 }
 
-func listenTCPClients() {
+func recordFromQuery(stream *DataStream, recordOptions interface{}) (err os.Error) {
+	switch options := recordOptions.(type) {
+	case bool:
+		if !options {
+			stream.Record(nil)
+		}
+		return
+	case map[string]interface{}:
+		recorder, err := NewRecorderFromOptions(recordingName(stream), func(name string) string {
+			if value, ok := options[name]; ok {
+				return fmt.Sprint(value)
+			}
+			return ""
+		}, true)
+		if err != nil {
+			return err
+		}
+		stream.Record(recorder)
+		return nil
+	}
+	return fmt.Errorf("Expected record options or false, got %v", recordOptions)
+}
 
-	ipAddr, err := net.ResolveIPAddr("tcp4", "127.0.0.1")
+// /admin/record?stream=ranger&action=start&maxBytes=1000000&maxAge=1h&maxFiles=24 or /admin/record?stream=ranger&action=stop
+// Like a query, it may also name a source or an env, and a format, to record the stream a query naming them gets.
+func ServeRecord(writer http.ResponseWriter, request *http.Request) {
+	streamName := request.FormValue("stream")
+	if streamName == "" {
+		http.Error(writer, "Missing stream", http.StatusBadRequest)
+		return
+	}
+	sourceURL, env := request.FormValue("source"), request.FormValue("env")
+	if sourceURL != "" && env != "" {
+		http.Error(writer, "Give a source or an env, not both", http.StatusBadRequest)
+		return
+	}
+	format := request.FormValue("format")
+	var source Source
+	var err os.Error
+	if env != "" {
+		source, err = EnvSource(env)
+	} else {
+		source, format, err = clientSource(streamName, sourceURL, format)
+	}
+	if err != nil {
+		http.Error(writer, err.String(), http.StatusBadRequest)
+		return
+	}
+	stream, err := StreamBySource(streamName, source, format)
 	if err != nil {
-		log.Fatal("Failed to resolve", err)
+		http.Error(writer, err.String(), http.StatusBadRequest)
+		return
 	}
+	defer ReleaseStream(stream)
 
-	addr := net.TCPAddr{ipAddr.IP, 3535}
+	switch request.FormValue("action") {
+	case "start":
+		recorder, err := NewRecorderFromOptions(recordingName(stream), func(name string) string { return request.FormValue(name) }, false)
+		if err != nil {
+			http.Error(writer, err.String(), http.StatusBadRequest)
+			return
+		}
+		stream.Record(recorder)
+		fmt.Fprintf(writer, "Started %v\n", recorder)
+	case "stop":
+		stream.Record(nil)
+		fmt.Fprintf(writer, "Stopped recording %s\n", streamName)
+	default:
+		http.Error(writer, "action should be start or stop", http.StatusBadRequest)
+	}
+}
 
-	listener, err := net.ListenTCP("tcp4", &addr)
+var tcpAddress = flag.String("tcp", "127.0.0.1:3535", "Address for the raw TCP interface")
+
+func listenTCPClients(address string) {
+	listener, err := net.Listen("tcp4", address)
 	if err != nil {
 		log.Fatal("Failed to listen", err)
 	}
+	serveTCPClients(listener)
+}
 
+// Serves each client that connects until the listener is closed.
+func serveTCPClients(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal("Failed to accept", err)
+			log.Println("Stopped accepting TCP clients:", err)
+			return
 		}
 
 		//protoConn := textproto.NewConn(conn)
@@ -215,31 +426,122 @@ func listenTCPClients() {
 	}
 }
 
+// All the streams we have open for a log, from any source. Unlike StreamByName this never creates one.
+func FindStreams(name string) (streams []*DataStream) {
+	return scribeStreams.Find(name)
+}
+
+// The stream for a log from the default source, or the derived stream of that name. Release it once done with it.
 func StreamByName(name string) (stream *DataStream) {
-	if stream, ok := scribeStreams[name]; ok {
-		return stream
+	if derived, ok := DerivedSource(name); ok {
+		stream, _ = StreamBySource(name, derived, "")
+		return
 	}
+	stream, _ = StreamBySource(name, defaultSource, "")
+	return
+}
+
+// Where a client's stream of a log comes from: the source it named, if it's allowed to, otherwise the derived
+// stream of that name or the default source. Derived streams are JSON, whatever format was asked for.
+func clientSource(logName string, sourceURL string, format string) (source Source, streamFormat string, err os.Error) {
+	if sourceURL != "" {
+		source, err = NewQuerySource(sourceURL)
+		return source, format, err
+	}
+	if derived, ok := DerivedSource(logName); ok {
+		return derived, "", nil
+	}
+	return defaultSource, format, nil
+}
 
-	scribeStreams[name] = NewDataStream(name, streamHost)
-	return scribeStreams[name]
+// Streams are unique per source and format, so the same log name can be followed from several places at once.
+// No format is JSON, and the same stream as asking for "json". Release it once done with it.
+func StreamBySource(name string, source Source, format string) (stream *DataStream, err os.Error) {
+	if format == "" {
+		format = "json"
+	}
+	key := source.String() + " " + name + " " + format
+	return scribeStreams.Get(key, func() (*DataStream, os.Error) {
+		decoder, err := NewDecoder(format)
+		if err != nil {
+			return nil, err
+		}
+		return NewDataStream(name, source, decoder), nil
+	})
+}
+
+// Lets go of a stream from StreamByName or StreamBySource, forgetting it if nobody else wants it.
+func ReleaseStream(stream *DataStream) {
+	scribeStreams.Release(stream)
+}
+
+var scribeEnvironments = []string{"dev", "stagea", "stagex", "prod"}
+
+// The scribe tailer for one of our environments
+func EnvSource(env string) (source Source, err os.Error) {
+	for _, known := range scribeEnvironments {
+		if env == known {
+			return NewSource(fmt.Sprintf("scribe-tail://scribe-%s.local.yelpcorp.com:3535", env))
+		}
+	}
+	return nil, fmt.Errorf("Unknown environment '%s', expected one of %v", env, scribeEnvironments)
+}
+
+// Whether source is the scribe tailer of one of our environments, or the one we were started with.
+func isKnownTailer(source Source) bool {
+	if defaultSource != nil && source.String() == defaultSource.String() {
+		return true
+	}
+	for _, env := range scribeEnvironments {
+		if envSource, err := EnvSource(env); err == nil && source.String() == envSource.String() {
+			return true
+		}
+	}
+	return false
 }
 
 var aggregator = flag.String("e", "dev", "One of {dev, stagea, stagex, prod}")
+var sourceURL = flag.String("source", "", "Upstream source URL (scribe-tail://, file://, unix:// or exec://). Defaults to the -e aggregator")
 
 func main() {
 	log.Println("Starting up")
 
 	flag.Parse()
-	streamHost = fmt.Sprintf("scribe-%s.local.yelpcorp.com:3535", *aggregator)
-	log.Println("Connecting to ", streamHost)
+	var err os.Error
+	if *sourceURL == "" {
+		defaultSource, err = EnvSource(*aggregator)
+	} else {
+		defaultSource, err = NewSource(*sourceURL)
+	}
+	if err != nil {
+		log.Fatal("Bad source: ", err)
+	}
+	if _, err = ParseDuration(*historyLength); err != nil {
+		log.Fatal("Bad -history: ", err)
+	}
+	if _, err = ParseDuration(*idleTimeout); err != nil {
+		log.Fatal("Bad -idle-timeout: ", err)
+	}
+	if err = checkMaxRates(); err != nil {
+		log.Fatal("Bad -max-rate: ", err)
+	}
+	if *derivedConfig != "" {
+		if err = LoadDerivedStreams(*derivedConfig); err != nil {
+			log.Fatal("Bad -derived: ", err)
+		}
+	}
+	log.Println("Connecting to ", defaultSource)
 
-	go listenTCPClients()
+	go listenTCPClients(*tcpAddress)
 
 	http.Handle("/", http.HandlerFunc(ServePage))
 	http.Handle("/lookup", http.HandlerFunc(ServeDataItemPage))
+	http.Handle("/admin/record", http.HandlerFunc(ServeRecord))
+	http.Handle("/admin/derive", http.HandlerFunc(ServeDerive))
+	http.Handle("/streams", http.HandlerFunc(ServeStreams))
 	http.Handle("/ws", websocket.Handler(ServeWS))
 
-	err := http.ListenAndServe(":8080", nil)
+	err = http.ListenAndServe(":8080", nil)
 	if err != nil {
 		panic("ListenAndServe: " + err.String())
 	}
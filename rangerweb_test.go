@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"faketailer"
+	"http"
+	"http/httptest"
+	"io"
+	"io/ioutil"
+	"json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"websocket"
+)
+
+var tailerFixture = `{"servlet": "home", "timing": {"total": 12}}
+{"servlet": "biz", "timing": {"total": 40}}
+`
+
+const streamQuery = `{"logName": "ranger", "fields": ["servlet", "timing.total"], "filters": []}` + "\n"
+
+// Speaks the scribe tailer protocol: reads a log name, sends lines back, then goes quiet until the client hangs up.
+// Points the default source at a faketailer serving tailerFixture as the ranger log, for the length of a test.
+// Returns a func to put it back.
+func useFakeTailer(t *testing.T) func() {
+	fixtures, err := ioutil.TempDir("", "rangerweb")
+	if err != nil {
+		t.Fatalf("Couldn't create fixtures: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(fixtures, "ranger.jsonl"), []byte(tailerFixture), 0644); err != nil {
+		t.Fatalf("Couldn't write fixture: %v", err)
+	}
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't start a tailer: %v", err)
+	}
+	go (&faketailer.Tailer{Fixtures: fixtures}).Serve(listener)
+
+	previous := defaultSource
+	defaultSource = &tailerSource{"tcp4", listener.Addr().String()}
+	return func() {
+		defaultSource = previous
+		listener.Close()
+		os.RemoveAll(fixtures)
+	}
+}
+
+// Reads rows from a client connection, skipping control frames.
+func readRows(t *testing.T, conn io.Reader, count int) (rows [][]interface{}) {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		reader := bufio.NewReader(conn)
+		for len(rows) < count {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				t.Errorf("Failed reading from the server: %v", err)
+				return
+			}
+			var frame interface{}
+			if err = json.Unmarshal(line, &frame); err != nil {
+				t.Errorf("Couldn't decode %s: %v", line, err)
+				return
+			}
+			if row, ok := frame.([]interface{}); ok {
+				rows = append(rows, row)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5e9):
+		t.Fatalf("Timed out with %d of %d rows", len(rows), count)
+	}
+	return
+}
+
+func checkRows(t *testing.T, rows [][]interface{}) {
+	expected := []string{`[["servlet","home"],["timing.total",12]]`, `[["servlet","biz"],["timing.total",40]]`}
+	for ndx, row := range rows {
+		encoded, _ := json.Marshal(row)
+		if string(encoded) != expected[ndx] {
+			t.Errorf("Row %d: expected %s, but was %s", ndx, expected[ndx], encoded)
+		}
+	}
+}
+
+func TestServeStreamOverWebSocket(t *testing.T) {
+	defer useFakeTailer(t)()
+
+	server := httptest.NewServer(websocket.Handler(ServeWS))
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws://"+server.Listener.Addr().String()+"/", "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer ws.Close()
+	if _, err = ws.Write([]byte(streamQuery)); err != nil {
+		t.Fatalf("Couldn't send the query: %v", err)
+	}
+
+	checkRows(t, readRows(t, ws, 2))
+}
+
+func TestServeStreamOverTCP(t *testing.T) {
+	defer useFakeTailer(t)()
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %v", err)
+	}
+	defer listener.Close()
+	go serveTCPClients(listener)
+
+	conn, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Couldn't connect: %v", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(streamQuery)); err != nil {
+		t.Fatalf("Couldn't send the query: %v", err)
+	}
+
+	checkRows(t, readRows(t, conn, 2))
+}
+
+func TestServeRecordFindsQueryStreams(t *testing.T) {
+	_, restore := useRecordDir(t)
+	defer restore()
+	previous := defaultSource
+	defaultSource = new(endlessSource)
+	defer func() { defaultSource = previous }()
+
+	serveRecord := func(query string) int {
+		request, err := http.NewRequest("GET", "http://localhost/admin/record?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := httptest.NewRecorder()
+		ServeRecord(response, request)
+		return response.Code
+	}
+
+	// The same stream a query for logfmt ranger from the default source gets, and not the JSON one
+	if code := serveRecord("stream=ranger&format=logfmt&action=start&maxBytes=1000"); code != http.StatusOK {
+		t.Fatalf("Expected to start recording, but got %d", code)
+	}
+	logfmt, _ := StreamBySource("ranger", defaultSource, "logfmt")
+	defer ReleaseStream(logfmt)
+	jsonStream, _ := StreamBySource("ranger", defaultSource, "")
+	defer ReleaseStream(jsonStream)
+	if !logfmt.Recording() || jsonStream.Recording() {
+		t.Errorf("Expected only the logfmt stream to be recorded")
+	}
+	if code := serveRecord("stream=ranger&format=logfmt&action=stop"); code != http.StatusOK || logfmt.Recording() {
+		t.Errorf("Expected to stop recording, but got %d", code)
+	}
+
+	// Sources are held to -query-sources, like a query's
+	for _, query := range []string{"stream=ranger&source=file:///etc/passwd&action=start", "stream=ranger&source=file:///etc/passwd&env=prod&action=start", "stream=ranger&env=nowhere&action=start"} {
+		if code := serveRecord(query); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, but got %d", query, code)
+		}
+	}
+}
+
+func TestServeStreamRefusesEnvsWithASource(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go func() {
+		ServeStream(NewJSONConn(server))
+		server.Close()
+	}()
+
+	query := `{"logName": "ranger", "envs": ["stagea", "prod"], "source": "scribe-tail://scribe-dev.local.yelpcorp.com:3535", "fields": [], "filters": []}` + "\n"
+	if _, err := client.Write([]byte(query)); err != nil {
+		t.Fatalf("Couldn't send the query: %v", err)
+	}
+	if line, err := bufio.NewReader(client).ReadString('\n'); err == nil {
+		t.Errorf("Expected the query to be refused, but got %s", line)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	recordDir      = flag.String("record-dir", "recordings", "Directory recordings of live streams are written to")
+	recordMaxBytes = flag.Int("record-max-bytes", 1024*1024*1024, "Most uncompressed bytes per file a recording can ask for, 0 for no limit")
+	recordMaxFiles = flag.Int("record-max-files", 168, "Most files per stream a recording can ask to keep, 0 for no limit")
+)
+
+// Defaults for a new recording, overridable per recording.
+const (
+	defaultRecordMaxBytes = 64 * 1024 * 1024 // Uncompressed bytes per file before rotating
+	defaultRecordMaxAge   = 3600e9           // Nanoseconds per file before rotating
+	defaultRecordMaxFiles = 24               // Files kept per stream, oldest are deleted first
+)
+
+// A Recorder tees the decoded lines of a DataStream into gzipped JSONL files named
+// <stream>@<source>-<time>-<seq>.jsonl.gz, rotating by size or age and pruning old files.
+// The files can be played back later through a replay:// source.
+type Recorder struct {
+	streamName string
+	dir        string
+	maxBytes   int64
+	maxAge     int64
+	maxFiles   int
+
+	lock       sync.Mutex
+	file       *os.File
+	compressor io.WriteCloser
+	written    int64 // Uncompressed bytes written to the current file
+	openedAt   int64
+	sequence   int
+	closed     bool
+}
+
+func NewRecorder(streamName string, maxBytes int64, maxAge int64, maxFiles int) (r *Recorder, err os.Error) {
+	err = os.MkdirAll(*recordDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	r = new(Recorder)
+	r.streamName = strings.Map(safeFileNameChar, streamName)
+	r.dir = *recordDir
+	r.maxBytes = maxBytes
+	r.maxAge = maxAge
+	r.maxFiles = maxFiles
+	return r, nil
+}
+
+// Builds a Recorder from named options (maxBytes, maxAge and maxFiles), as found in a query or a request's form values.
+// Missing options get the defaults. Nobody gets more than -record-max-bytes per file or -record-max-files files, and
+// queries, which anyone can send, can't ask for no limit (0) even when there's no maximum.
+func NewRecorderFromOptions(streamName string, option func(name string) string, fromQuery bool) (r *Recorder, err os.Error) {
+	maxBytes, maxAge, maxFiles := int64(defaultRecordMaxBytes), int64(defaultRecordMaxAge), defaultRecordMaxFiles
+
+	if value := option("maxBytes"); value != "" {
+		bytes, err := strconv.Atof64(value)
+		if err != nil || bytes < 0 {
+			return nil, fmt.Errorf("maxBytes should be a positive number of bytes. Got '%s'", value)
+		}
+		maxBytes = int64(bytes)
+	}
+	if value := option("maxAge"); value != "" {
+		maxAge, err = ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if value := option("maxFiles"); value != "" {
+		files, err := strconv.Atof64(value)
+		if err != nil || files < 0 {
+			return nil, fmt.Errorf("maxFiles should be a positive number of files. Got '%s'", value)
+		}
+		maxFiles = int(files)
+	}
+	if err = checkRecordLimit("maxBytes", maxBytes, int64(*recordMaxBytes), fromQuery); err != nil {
+		return nil, err
+	}
+	if err = checkRecordLimit("maxFiles", int64(maxFiles), int64(*recordMaxFiles), fromQuery); err != nil {
+		return nil, err
+	}
+	return NewRecorder(streamName, maxBytes, maxAge, maxFiles)
+}
+
+// Recordings without a limit on file size or count can fill the disk.
+func checkRecordLimit(name string, value int64, max int64, fromQuery bool) os.Error {
+	if value == 0 && fromQuery {
+		return fmt.Errorf("Queries can't record without a limit on %s", name)
+	}
+	if max > 0 && (value == 0 || value > max) {
+		return fmt.Errorf("%s can be at most %d. Got %d", name, max, value)
+	}
+	return nil
+}
+
+// What a stream's recordings are called. The same log can be streamed from several sources at once (and its
+// recordings pruned independently), so the source is part of the name.
+func recordingName(stream *DataStream) string {
+	return stream.name + "@" + stream.source.String()
+}
+
+func safeFileNameChar(c int) int {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || isDigit(c) || c == '.' || c == '-' || c == '@' {
+		return c
+	}
+	return '_'
+}
+
+func (r *Recorder) Record(line []byte) (err os.Error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.closed {
+		return os.NewError("Recorder is closed")
+	}
+
+	if r.file != nil && r.shouldRotate() {
+		err = r.closeFile()
+		if err != nil {
+			log.Printf("Failed to finish recording for %s: %v", r.streamName, err)
+		}
+	}
+	if r.file == nil {
+		err = r.openFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := r.compressor.Write(line)
+	r.written += int64(n)
+	if err != nil {
+		return err
+	}
+	_, err = r.compressor.Write([]byte{'\n'})
+	r.written++
+	return err
+}
+
+func (r *Recorder) Close() (err os.Error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = true
+	if r.file != nil {
+		err = r.closeFile()
+	}
+	return
+}
+
+func (r *Recorder) String() string {
+	return fmt.Sprintf("Recorder(%s, maxBytes=%d, maxAge=%.0fs, maxFiles=%d)", filepath.Join(r.dir, r.streamName), r.maxBytes, float64(r.maxAge)/1e9, r.maxFiles)
+}
+
+func (r *Recorder) shouldRotate() bool {
+	if r.maxBytes > 0 && r.written >= r.maxBytes {
+		return true
+	}
+	if r.maxAge > 0 && time.Nanoseconds()-r.openedAt >= r.maxAge {
+		return true
+	}
+	return false
+}
+
+func (r *Recorder) openFile() (err os.Error) {
+	r.sequence++
+	name := fmt.Sprintf("%s-%s-%04d.jsonl.gz", r.streamName, time.UTC().Format("20060102-150405"), r.sequence)
+	path := filepath.Join(r.dir, name)
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	compressor, err := gzip.NewWriter(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	log.Printf("Recording %s to %s", r.streamName, path)
+
+	r.file, r.compressor = file, compressor
+	r.written, r.openedAt = 0, time.Nanoseconds()
+
+	r.pruneFiles()
+	return nil
+}
+
+func (r *Recorder) closeFile() (err os.Error) {
+	err = r.compressor.Close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file, r.compressor = nil, nil
+	return
+}
+
+// Removes our oldest recordings until we're within maxFiles. The timestamp in the names means they sort oldest first.
+func (r *Recorder) pruneFiles() {
+	if r.maxFiles <= 0 {
+		return
+	}
+
+	infos, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		log.Printf("Failed to list recordings in %s: %v", r.dir, err)
+		return
+	}
+
+	// Other streams' names may start with ours, but our prefix is always followed by the timestamp.
+	prefix := r.streamName + "-"
+	recordings := []string{}
+	for _, info := range infos {
+		name := info.Name
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) && '0' <= name[len(prefix)] && name[len(prefix)] <= '9' && strings.HasSuffix(name, ".jsonl.gz") {
+			recordings = append(recordings, name)
+		}
+	}
+
+	for len(recordings) > r.maxFiles {
+		path := filepath.Join(r.dir, recordings[0])
+		log.Printf("Removing old recording %s", path)
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove %s: %v", path, err)
+		}
+		recordings = recordings[1:]
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Points -record-dir at a fresh directory for the length of a test. Returns the directory and a func to put it back.
+func useRecordDir(t *testing.T) (dir string, restore func()) {
+	dir, err := ioutil.TempDir("", "scribe_explorer")
+	if err != nil {
+		t.Fatalf("Couldn't create a directory: %v", err)
+	}
+	previous := *recordDir
+	*recordDir = dir
+	return dir, func() {
+		*recordDir = previous
+		os.RemoveAll(dir)
+	}
+}
+
+// The recordings in dir, oldest first
+func recordings(t *testing.T, dir string) (names []string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Couldn't list %s: %v", dir, err)
+	}
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// The lines of a gzipped recording
+func readRecording(t *testing.T, path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %v", path, err)
+	}
+	defer file.Close()
+	decompressor, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("%s isn't gzipped: %v", path, err)
+	}
+	contents, err := ioutil.ReadAll(decompressor)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", path, err)
+	}
+	return strings.Split(strings.TrimRight(string(contents), "\n"), "\n")
+}
+
+func record(t *testing.T, recorder *Recorder, lines ...string) {
+	for _, line := range lines {
+		if err := recorder.Record([]byte(line)); err != nil {
+			t.Fatalf("Couldn't record %s: %v", line, err)
+		}
+	}
+}
+
+func TestRecorderRotatesBySize(t *testing.T) {
+	dir, restore := useRecordDir(t)
+	defer restore()
+
+	// Each line is 20 bytes with its newline, so two fill a file
+	recorder, err := NewRecorder("ranger", 40, 0, 0)
+	if err != nil {
+		t.Fatalf("Couldn't create recorder: %v", err)
+	}
+	record(t, recorder, `{"servlet": "home"}`, `{"servlet": "biz0"}`, `{"servlet": "user"}`)
+	recorder.Close()
+	if err = recorder.Record([]byte(`{"servlet": "late"}`)); err == nil {
+		t.Errorf("Expected recording after closing to fail")
+	}
+
+	names := recordings(t, dir)
+	if len(names) != 2 {
+		t.Fatalf("Expected two files, but was %v", names)
+	}
+	for ndx, expected := range [][]string{[]string{`{"servlet": "home"}`, `{"servlet": "biz0"}`}, []string{`{"servlet": "user"}`}} {
+		if !strings.HasPrefix(names[ndx], "ranger-") || !strings.HasSuffix(names[ndx], ".jsonl.gz") {
+			t.Errorf("Expected a ranger-<time>-<seq>.jsonl.gz recording, but was %s", names[ndx])
+		}
+		lines := readRecording(t, filepath.Join(dir, names[ndx]))
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expected %s to hold %v, but was %v", names[ndx], expected, lines)
+		}
+	}
+}
+
+func TestRecorderRotatesByAge(t *testing.T) {
+	dir, restore := useRecordDir(t)
+	defer restore()
+
+	recorder, err := NewRecorder("ranger", 0, 50e6, 0)
+	if err != nil {
+		t.Fatalf("Couldn't create recorder: %v", err)
+	}
+	record(t, recorder, `{"servlet": "home"}`, `{"servlet": "biz"}`)
+	time.Sleep(60e6)
+	record(t, recorder, `{"servlet": "user"}`)
+	recorder.Close()
+
+	if names := recordings(t, dir); len(names) != 2 {
+		t.Errorf("Expected a new file once the first was 50ms old, but was %v", names)
+	}
+}
+
+func TestRecorderPrunesOldFiles(t *testing.T) {
+	dir, restore := useRecordDir(t)
+	defer restore()
+
+	// Someone else's recording, whose name happens to start with ours
+	other := "ranger-errors-20120101-120000-0001.jsonl.gz"
+	if err := ioutil.WriteFile(filepath.Join(dir, other), []byte{}, 0644); err != nil {
+		t.Fatalf("Couldn't create %s: %v", other, err)
+	}
+
+	recorder, err := NewRecorder("ranger", 1, 0, 2)
+	if err != nil {
+		t.Fatalf("Couldn't create recorder: %v", err)
+	}
+	record(t, recorder, `{"n": 1}`, `{"n": 2}`, `{"n": 3}`, `{"n": 4}`, `{"n": 5}`)
+	recorder.Close()
+
+	names := recordings(t, dir)
+	if len(names) != 3 || names[2] != other {
+		t.Fatalf("Expected our two newest files and the other recording, but was %v", names)
+	}
+	for ndx, expected := range []string{`{"n": 4}`, `{"n": 5}`} {
+		if lines := readRecording(t, filepath.Join(dir, names[ndx])); len(lines) != 1 || lines[0] != expected {
+			t.Errorf("Expected %s to hold %s, but was %v", names[ndx], expected, lines)
+		}
+	}
+}
+
+func TestRecordingNames(t *testing.T) {
+	_, restore := useRecordDir(t)
+	defer restore()
+
+	source, err := NewSource("scribe-tail://scribe-prod.local.yelpcorp.com:3535")
+	if err != nil {
+		t.Fatalf("Couldn't create source: %v", err)
+	}
+	stream := NewDataStream("ranger", source, new(jsonDecoder))
+	if name := recordingName(stream); name != "ranger@scribe-tail://scribe-prod.local.yelpcorp.com:3535" {
+		t.Errorf("Expected the recording to be named for the log and source, but was %s", name)
+	}
+
+	for name, expected := range map[string]string{
+		recordingName(stream): "ranger@scribe-tail___scribe-prod.local.yelpcorp.com_3535",
+		"../../etc/passwd":    ".._.._etc_passwd",
+		"ranger errors?x=1&y": "ranger_errors_x_1_y",
+		"Ranger-2@exec://a b": "Ranger-2@exec___a_b",
+	} {
+		recorder, err := NewRecorder(name, 0, 0, 0)
+		if err != nil {
+			t.Fatalf("Couldn't create recorder: %v", err)
+		}
+		if recorder.streamName != expected {
+			t.Errorf("Expected %s to be recorded as %s, but was %s", name, expected, recorder.streamName)
+		}
+	}
+}
+
+type recorderOptionsTest struct {
+	options   map[string]string
+	fromQuery bool
+	ok        bool
+}
+
+var recorderOptionsTests = []recorderOptionsTest{
+	recorderOptionsTest{map[string]string{}, true, true},
+	recorderOptionsTest{map[string]string{"maxBytes": "1000", "maxAge": "10m", "maxFiles": "10"}, true, true},
+	recorderOptionsTest{map[string]string{"maxFiles": "0"}, true, false},
+	recorderOptionsTest{map[string]string{"maxBytes": "0"}, true, false},
+	recorderOptionsTest{map[string]string{"maxFiles": "1000"}, true, false},
+	recorderOptionsTest{map[string]string{"maxBytes": "1e12"}, false, false},
+	recorderOptionsTest{map[string]string{"maxFiles": "0"}, false, false},
+	recorderOptionsTest{map[string]string{"maxFiles": "-1"}, false, false},
+	recorderOptionsTest{map[string]string{"maxAge": "forever"}, false, false},
+}
+
+func TestRecorderOptionsAreLimited(t *testing.T) {
+	_, restore := useRecordDir(t)
+	defer restore()
+
+	for _, test := range recorderOptionsTests {
+		_, err := NewRecorderFromOptions("ranger", func(name string) string { return test.options[name] }, test.fromQuery)
+		if test.ok && err != nil {
+			t.Errorf("Expected to record with %v, got %v", test.options, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("Expected recording with %v to be refused", test.options)
+		}
+	}
+
+	// With no maximums, only queries are held back from recording without limits
+	defer func(maxBytes int, maxFiles int) { *recordMaxBytes, *recordMaxFiles = maxBytes, maxFiles }(*recordMaxBytes, *recordMaxFiles)
+	*recordMaxBytes, *recordMaxFiles = 0, 0
+	unlimited := func(name string) string { return "0" }
+	if _, err := NewRecorderFromOptions("ranger", unlimited, false); err != nil {
+		t.Errorf("Expected the admin endpoint to be able to record without limits, got %v", err)
+	}
+	if _, err := NewRecorderFromOptions("ranger", unlimited, true); err == nil {
+		t.Errorf("Expected a query not to be able to record without limits")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+/*
+ * The regular expression argument of Matches, Extract and RegexReplace. Written as a literal, as it almost always
+ * is, it's compiled once when the statement is parsed. Otherwise it's compiled as it changes.
+ */
+type regexpArg struct {
+	expr     Expression
+	compiled *regexp.Regexp
+	literal  bool
+}
+
+func newRegexpArg(fname string, expr Expression) (arg *regexpArg, err os.Error) {
+	arg = &regexpArg{expr: expr}
+	literal, ok := expr.(*Literal)
+	if !ok {
+		return arg, nil
+	}
+	pattern, ok := literal.value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string regular expression, got %T %v", fname, literal.value, literal.value)
+	}
+	if arg.compiled, err = regexp.Compile(pattern); err != nil {
+		return nil, fmt.Errorf("%s couldn't compile %s: %v", fname, strconv.Quote(pattern), err)
+	}
+	arg.literal = true
+	return arg, nil
+}
+
+func (arg *regexpArg) Regexp(fname string, data JSONData) (re *regexp.Regexp, err os.Error) {
+	if arg.literal {
+		return arg.compiled, nil
+	}
+	pattern, present, err := evaluateString(fname, arg.expr, data)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, fmt.Errorf("%s expects a regular expression, but %v is missing", fname, arg.expr)
+	}
+	if arg.compiled == nil || arg.compiled.String() != pattern {
+		if arg.compiled, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("%s couldn't compile %s: %v", fname, strconv.Quote(pattern), err)
+		}
+	}
+	return arg.compiled, nil
+}
+
+func (arg *regexpArg) String() string {
+	return arg.expr.String()
+}
+
+/*
+ * Matches(s string, regexp string) -> bool
+ *
+ * Whether the regular expression matches anywhere in s, e.g. Matches(agent, "(?i)bot|crawler|spider"). A missing
+ * s matches nothing.
+ */
+type Matches struct {
+	expr    Expression
+	pattern *regexpArg
+}
+
+func (m *Matches) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 2 {
+		return fmt.Errorf("Matches expects two arguments, a string and a regular expression")
+	}
+	m.expr = args[0]
+	m.pattern, err = newRegexpArg(fname, args[1])
+	return
+}
+
+func (m *Matches) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	s, present, err := evaluateString("Matches", m.expr, data)
+	if err != nil {
+		return nil, err
+	}
+	re, err := m.pattern.Regexp("Matches", data)
+	if err != nil {
+		return nil, err
+	}
+	return present && re.MatchString(s), nil
+}
+
+func (m *Matches) String() string {
+	return fmt.Sprintf("Matches(%v,%v)", m.expr, m.pattern)
+}
+
+/*
+ * Extract(s string, regexp string[, group int]) -> string
+ *
+ * The text the regular expression's group (counting from 1, or 0 for the whole match) matched in s, e.g.
+ * Extract(uri, "/biz/([^/?]+)", 1) for the business of a biz page. With no group it's the whole match. Gives nil
+ * if there's no match, or s is missing.
+ */
+type Extract struct {
+	expr    Expression
+	pattern *regexpArg
+	group   Expression
+}
+
+func (e *Extract) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("Extract expects a string, a regular expression and optionally the group to extract")
+	}
+	e.expr = args[0]
+	if e.pattern, err = newRegexpArg(fname, args[1]); err != nil {
+		return err
+	}
+	e.group = &Literal{0}
+	if len(args) == 3 {
+		if err = checkLiteral(fname, args[2], "non-negative int"); err != nil {
+			return err
+		}
+		e.group = args[2]
+	}
+
+	if group, ok := e.group.(*Literal); ok && e.pattern.literal {
+		if count, _ := countValue(group.value); count > e.pattern.compiled.NumSubexp() {
+			return fmt.Errorf("Extract can't have group %v of %v, it only has %d", group, e.pattern, e.pattern.compiled.NumSubexp())
+		}
+	}
+	return nil
+}
+
+func (e *Extract) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	s, present, err := evaluateString("Extract", e.expr, data)
+	if err != nil {
+		return nil, err
+	}
+	re, err := e.pattern.Regexp("Extract", data)
+	if err != nil {
+		return nil, err
+	}
+	group, err := evaluateCount("Extract", e.group, data)
+	if err != nil {
+		return nil, err
+	}
+	if group > re.NumSubexp() {
+		return nil, fmt.Errorf("Extract can't have group %d of %v, it only has %d", group, e.pattern, re.NumSubexp())
+	}
+	if !present {
+		return nil, nil
+	}
+
+	match := re.FindStringSubmatchIndex(s)
+	if match == nil || match[2*group] < 0 {
+		return nil, nil
+	}
+	return s[match[2*group]:match[2*group+1]], nil
+}
+
+func (e *Extract) String() string {
+	return fmt.Sprintf("Extract(%v,%v,%v)", e.expr, e.pattern, e.group)
+}
+
+/*
+ * RegexReplace(s string, regexp string, replacement string) -> string
+ *
+ * Replaces every match of the regular expression in s. In the replacement, $1 or ${1} stands for what the first
+ * group matched (and so on), $0 for the whole match and $$ for a $. A missing s stays missing.
+ */
+type RegexReplace struct {
+	expr        Expression
+	pattern     *regexpArg
+	replacement Expression
+}
+
+func (r *RegexReplace) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 3 {
+		return fmt.Errorf("RegexReplace expects three arguments, a string, a regular expression and its replacement")
+	}
+	r.expr = args[0]
+	if r.pattern, err = newRegexpArg(fname, args[1]); err != nil {
+		return err
+	}
+	if err = checkLiteral(fname, args[2], "string"); err != nil {
+		return err
+	}
+	r.replacement = args[2]
+	return nil
+}
+
+func (r *RegexReplace) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	s, present, err := evaluateString("RegexReplace", r.expr, data)
+	if err != nil {
+		return nil, err
+	}
+	re, err := r.pattern.Regexp("RegexReplace", data)
+	if err != nil {
+		return nil, err
+	}
+	replacement, _, err := evaluateString("RegexReplace", r.replacement, data)
+	if err != nil {
+		return nil, err
+	}
+	if !present {
+		return nil, nil
+	}
+
+	var replaced bytes.Buffer
+	last := 0
+	for _, match := range re.FindAllStringSubmatchIndex(s, -1) {
+		replaced.WriteString(s[last:match[0]])
+		expandGroups(&replaced, replacement, s, match)
+		last = match[1]
+	}
+	replaced.WriteString(s[last:])
+	return replaced.String(), nil
+}
+
+func (r *RegexReplace) String() string {
+	return fmt.Sprintf("RegexReplace(%v,%v,%v)", r.expr, r.pattern, r.replacement)
+}
+
+// Writes out the replacement for one match, with $n and ${n} swapped for what group n matched in s.
+func expandGroups(buf *bytes.Buffer, replacement string, s string, match []int) {
+	for i := 0; i < len(replacement); i++ {
+		if replacement[i] != '$' || i+1 == len(replacement) {
+			buf.WriteByte(replacement[i])
+			continue
+		}
+		if replacement[i+1] == '$' {
+			buf.WriteByte('$')
+			i++
+			continue
+		}
+
+		start := i + 1
+		braced := replacement[start] == '{'
+		if braced {
+			start++
+		}
+		end := start
+		for end < len(replacement) && isDigit(int(replacement[end])) {
+			end++
+		}
+		if end == start || braced && (end == len(replacement) || replacement[end] != '}') {
+			// Not a group after all
+			buf.WriteByte('$')
+			continue
+		}
+
+		group, _ := strconv.Atoi(replacement[start:end])
+		if 2*group+1 < len(match) && match[2*group] >= 0 {
+			buf.WriteString(s[match[2*group]:match[2*group+1]])
+		}
+		i = end - 1
+		if braced {
+			i = end
+		}
+	}
+}
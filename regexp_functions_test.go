@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+)
+
+var regexpFunctionTests = []expressionTest{
+	expressionTest{`Matches(agent, "(?i)bot|crawler|spider")`, true, true},
+	expressionTest{`Matches(uri, "^/biz/")`, true, true},
+	expressionTest{`Matches(uri, "^/user/")`, false, true},
+	expressionTest{`Matches(not_there, ".*")`, false, true},
+	expressionTest{`Matches(status, "2..")`, nil, false},
+	expressionTest{`Matches(uri, pattern)`, true, true},
+	expressionTest{`Matches(uri, not_there)`, nil, false},
+	expressionTest{`Matches(uri, bad_pattern)`, nil, false},
+
+	expressionTest{`Extract(uri, "/biz/([^/?]+)", 1)`, "pizza-place", true},
+	expressionTest{`Extract(uri, "osq=(\\w+)")`, "osq=pizza", true},
+	expressionTest{`Extract(uri, "osq=(\\w+)", 0)`, "osq=pizza", true},
+	expressionTest{`Extract(uri, "/user/(\\w+)", 1)`, nil, true},
+	expressionTest{`Extract(uri, "/biz/(\\d+)?", 1)`, nil, true},
+	expressionTest{`Extract(not_there, "(.*)", 1)`, nil, true},
+	expressionTest{`Extract(uri, pattern, 2)`, nil, false},
+
+	expressionTest{`RegexReplace(uri, "\\?.*", "")`, "/biz/pizza-place", true},
+	expressionTest{`RegexReplace(uri, "/biz/([^/?]+)", "/biz/<$1>")`, "/biz/<pizza-place>?osq=pizza", true},
+	expressionTest{`RegexReplace(uri, "(\\w+)=(\\w+)", "${2}x$1 $$1 $0")`, "/biz/pizza-place?pizzaxosq $1 osq=pizza", true},
+	expressionTest{`RegexReplace(servlet, "o", "0")`, "h0me", true},
+	expressionTest{`RegexReplace(servlet, "x", "y")`, "home", true},
+	expressionTest{`RegexReplace(servlet, "(x)?o", "[$1]")`, "h[]me", true},
+	expressionTest{`RegexReplace(servlet, "o", "$")`, "h$me", true},
+	expressionTest{`RegexReplace(not_there, "o", "0")`, nil, true},
+}
+
+func TestRegexpFunctions(t *testing.T) {
+	event := `{"servlet": "home", "status": 200, "uri": "/biz/pizza-place?osq=pizza",
+		"agent": "Mozilla/5.0 (compatible; Googlebot/2.1)", "pattern": "^/biz/(.*)", "bad_pattern": "("}`
+	checkExpressions(t, event, regexpFunctionTests)
+}
+
+func TestRegexpFunctionSetup(t *testing.T) {
+	for _, statement := range []string{
+		`Matches(uri, "(")`,
+		"Matches(uri, 5)",
+		"Matches(uri)",
+		`Extract(uri, "a(b)", 2)`,
+		`Extract(uri, "a(b)", "1")`,
+		`RegexReplace(uri, "[", "")`,
+		`RegexReplace(uri, "a", 1)`,
+	} {
+		if expr, err := Parse(statement); err == nil {
+			t.Errorf("Expected an error parsing %s, got %v", statement, expr)
+		}
+	}
+}
+
+func TestLiteralRegexpCompiledOnce(t *testing.T) {
+	expr, err := Parse(`Matches(agent, "bot")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := expr.(*Matches)
+	compiled := matches.pattern.compiled
+	if compiled == nil {
+		t.Fatal("Expected a literal pattern to be compiled when parsed")
+	}
+	for _, agent := range []string{"Googlebot", "Firefox"} {
+		matches.Evaluate(map[string]interface{}{"agent": agent})
+		if matches.pattern.compiled != compiled {
+			t.Errorf("Expected a literal pattern to stay compiled")
+		}
+	}
+
+	// Patterns from the event are compiled as they come, and again only when they change
+	expr, err = Parse("Matches(agent, pattern)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches = expr.(*Matches)
+	if matches.pattern.compiled != nil {
+		t.Errorf("Didn't expect a pattern from the event to be compiled up front")
+	}
+	matches.Evaluate(map[string]interface{}{"agent": "Googlebot", "pattern": "bot"})
+	compiled = matches.pattern.compiled
+	matches.Evaluate(map[string]interface{}{"agent": "Firefox", "pattern": "bot"})
+	if matches.pattern.compiled != compiled {
+		t.Errorf("Expected an unchanged pattern not to be compiled again")
+	}
+	result, _ := matches.Evaluate(map[string]interface{}{"agent": "Firefox", "pattern": "fox$"})
+	if result != true || matches.pattern.compiled == compiled {
+		t.Errorf("Expected a changed pattern to be compiled, got %v", result)
+	}
+}
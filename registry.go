@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// Every stream we have open, keyed by source, log name and format. ServeStream goroutines look streams up
+// and create them concurrently, so the maps are only touched holding lock.
+type streamRegistry struct {
+	lock    sync.Mutex
+	streams map[string]*DataStream
+	users   map[*DataStream]int // How many Gets of each stream haven't been Released yet
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[string]*DataStream), users: make(map[*DataStream]int)}
+}
+
+// Returns the stream for key, calling create to make it if there isn't one yet.
+// Two goroutines asking for the same key at once get the same stream. Release it once done with it.
+func (r *streamRegistry) Get(key string, create func() (*DataStream, os.Error)) (stream *DataStream, err os.Error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stream, ok := r.streams[key]
+	if !ok {
+		stream, err = create()
+		if err != nil {
+			return nil, err
+		}
+		r.streams[key] = stream
+	}
+	r.users[stream]++
+	return stream, nil
+}
+
+// Lets go of a stream from Get. Clients can make up any number of streams, so once nobody is using one (and it
+// isn't being recorded) we forget it, and the next Get starts afresh.
+func (r *streamRegistry) Release(stream *DataStream) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	users, ok := r.users[stream]
+	if !ok {
+		return
+	}
+	if users > 1 {
+		r.users[stream] = users - 1
+		return
+	}
+	r.users[stream] = 0
+	if stream.Recording() {
+		return
+	}
+	r.users[stream] = 0, false
+	for key, registered := range r.streams {
+		if registered == stream {
+			r.streams[key] = nil, false
+		}
+	}
+}
+
+// All the streams we have open for a log, from any source.
+func (r *streamRegistry) Find(name string) (streams []*DataStream) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, stream := range r.streams {
+		if stream.name == name {
+			streams = append(streams, stream)
+		}
+	}
+	return
+}
+
+func (r *streamRegistry) All() (streams []*DataStream) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	streams = make([]*DataStream, 0, len(r.streams))
+	for _, stream := range r.streams {
+		streams = append(streams, stream)
+	}
+	return
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRegistryCreatesOnce(t *testing.T) {
+	registry := newStreamRegistry()
+	source := new(endlessSource)
+
+	const getters = 20
+	created, found := make(chan bool, getters), make(chan *DataStream)
+	for i := 0; i < getters; i++ {
+		go func() {
+			stream, _ := registry.Get("endless ranger", func() (*DataStream, os.Error) {
+				created <- true
+				return NewDataStream("ranger", source, new(jsonDecoder)), nil
+			})
+			found <- stream
+		}()
+	}
+
+	first := <-found
+	for i := 1; i < getters; i++ {
+		if stream := <-found; stream != first {
+			t.Errorf("Expected every getter to get the same stream")
+		}
+	}
+	if len(created) != 1 {
+		t.Errorf("Expected the stream to be created once, but was %d times", len(created))
+	}
+	if streams := registry.Find("ranger"); len(streams) != 1 || streams[0] != first {
+		t.Errorf("Expected to find the one stream, but found %v", streams)
+	}
+	if streams := registry.Find("biz"); len(streams) != 0 {
+		t.Errorf("Expected no biz streams, but found %v", streams)
+	}
+}
+
+func TestStreamBySourceDefaultsToJSON(t *testing.T) {
+	source := new(endlessSource)
+	defaulted, err := StreamBySource("format_test", source, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream, _ := StreamBySource("format_test", source, "json"); stream != defaulted {
+		t.Errorf("Expected no format and json to be the same stream")
+	}
+	if stream, _ := StreamBySource("format_test", source, "logfmt"); stream == defaulted {
+		t.Errorf("Expected logfmt to be a stream of its own")
+	}
+}
+
+func TestRegistryForgetsUnusedStreams(t *testing.T) {
+	registry := newStreamRegistry()
+	create := func() (*DataStream, os.Error) {
+		return NewDataStream("ranger", new(endlessSource), new(jsonDecoder)), nil
+	}
+
+	first, _ := registry.Get("endless ranger", create)
+	second, _ := registry.Get("endless ranger", create)
+	registry.Release(first)
+	if streams := registry.Find("ranger"); len(streams) != 1 {
+		t.Errorf("Expected the stream to stay while it's still in use, but found %v", streams)
+	}
+	registry.Release(second)
+	if streams := registry.Find("ranger"); len(streams) != 0 {
+		t.Errorf("Expected the stream to be forgotten once nobody uses it, but found %v", streams)
+	}
+
+	// Recording keeps a stream around with nobody using it, until it stops
+	recorded, _ := registry.Get("endless ranger", create)
+	if recorded == first {
+		t.Errorf("Expected a fresh stream after the last one was forgotten")
+	}
+	recorded.recorder = new(Recorder)
+	registry.Release(recorded)
+	if streams := registry.Find("ranger"); len(streams) != 1 || streams[0] != recorded {
+		t.Errorf("Expected the recorded stream to stay, but found %v", streams)
+	}
+	if stream, _ := registry.Get("endless ranger", create); stream != recorded {
+		t.Errorf("Expected to get the recorded stream back")
+	}
+	recorded.recorder = nil
+	registry.Release(recorded)
+	if streams := registry.Find("ranger"); len(streams) != 0 {
+		t.Errorf("Expected the stream to be forgotten once it stopped recording, but found %v", streams)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"http"
+	"io"
+	"json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * replay:///path/to/recording.jsonl?field=timestamp&speed=1
+ *
+ * Plays back a recorded newline delimited JSON file (optionally gzipped, as written by a Recorder)
+ * as if it were live. Events are paced by the (unix seconds) timestamp found at the GetDeep path
+ * given by field. speed=N plays N times faster than real time, and speed=max plays everything as
+ * fast as we can read it.
+ */
+type replaySource struct {
+	path  string
+	field string
+	speed float64 // 0 means as fast as possible
+}
+
+const defaultReplayField = "timestamp"
+
+func newReplaySource(address string) (source Source, err os.Error) {
+	s := &replaySource{path: address, field: defaultReplayField, speed: 1}
+
+	if queryNdx := strings.Index(address, "?"); queryNdx >= 0 {
+		s.path = address[:queryNdx]
+		params, err := http.ParseQuery(address[queryNdx+1:])
+		if err != nil {
+			return nil, err
+		}
+		if field := params.Get("field"); field != "" {
+			s.field = field
+		}
+		switch speed := params.Get("speed"); speed {
+		case "":
+		case "max":
+			s.speed = 0
+		default:
+			s.speed, err = strconv.Atof64(speed)
+			if err != nil || s.speed <= 0 {
+				return nil, fmt.Errorf("Replay speed should be a positive number or 'max'. Got '%s'", speed)
+			}
+		}
+	}
+	if s.path == "" {
+		return nil, fmt.Errorf("replay source needs a file to play")
+	}
+	return s, nil
+}
+
+func (s *replaySource) Open(logName string) (stream io.ReadCloser, err os.Error) {
+	path := s.path
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDirectory() {
+		if path, err = logFilePath(path, logName); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Recordings are written gzipped, so play those back directly.
+	var recording io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		recording, err = gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	reader, writer := io.Pipe()
+	go s.replay(file, recording, writer)
+	return reader, nil
+}
+
+func (s *replaySource) Finite() bool {
+	return true
+}
+
+func (s *replaySource) String() string {
+	speed := "max"
+	if s.speed > 0 {
+		speed = strconv.Ftoa64(s.speed, 'g', -1)
+	}
+	return fmt.Sprintf("replay://%s?field=%s&speed=%s", s.path, s.field, speed)
+}
+
+// Copies lines from the recording to the pipe, sleeping as needed to keep pace with the recorded timestamps.
+// Returns once the recording runs out or whoever is reading the pipe closes it.
+func (s *replaySource) replay(file *os.File, recording io.Reader, writer *io.PipeWriter) {
+	defer file.Close()
+
+	lines, err := bufio.NewReaderSize(recording, 1024*32)
+	if err != nil {
+		writer.CloseWithError(err)
+		return
+	}
+
+	var firstEventTime float64
+	var startTime int64
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(line) > 0 {
+			if s.speed > 0 {
+				if eventTime, ok := s.eventTime(line); ok {
+					if startTime == 0 {
+						firstEventTime, startTime = eventTime, time.Nanoseconds()
+					}
+					due := startTime + int64((eventTime-firstEventTime)/s.speed*1e9)
+					if wait := due - time.Nanoseconds(); wait > 0 {
+						time.Sleep(wait)
+					}
+				}
+			}
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if _, err := writer.Write(line); err != nil {
+				// Nobody is listening any more
+				return
+			}
+		}
+		if err != nil {
+			if err == os.EOF {
+				writer.Close()
+			} else {
+				writer.CloseWithError(err)
+			}
+			return
+		}
+	}
+}
+
+func (s *replaySource) eventTime(line []byte) (eventTime float64, ok bool) {
+	var data JSONData
+	if err := json.Unmarshal(line, &data); err != nil {
+		return 0, false
+	}
+	value, ok := GetDeep(s.field, data)
+	if !ok {
+		return 0, false
+	}
+	return unixSeconds(value)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var replayFixture = `{"servlet": "home", "timestamp": 100, "start_time": 1000}
+{"servlet": "biz", "timestamp": 100.1, "start_time": 1002}
+{"servlet": "search", "timestamp": 100.2, "start_time": 1004}
+`
+
+// Plays a recording through to the end, returning its lines and how long they took to come, in nanoseconds.
+func playAll(t *testing.T, url string, logName string) (lines []string, took int64) {
+	source, err := NewSource(url)
+	if err != nil {
+		t.Fatalf("Couldn't create source: %v", err)
+	}
+	stream, err := source.Open(logName)
+	if err != nil {
+		t.Fatalf("Couldn't open %v: %v", source, err)
+	}
+	defer stream.Close()
+
+	start := time.Nanoseconds()
+	contents, err := ioutil.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("Failed playing %v: %v", source, err)
+	}
+	return strings.Split(strings.TrimRight(string(contents), "\n"), "\n"), time.Nanoseconds() - start
+}
+
+func checkReplayed(t *testing.T, url string, lines []string) {
+	expected := strings.Split(strings.TrimRight(replayFixture, "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %s to play %d lines, but was %d", url, len(expected), len(lines))
+	}
+	for ndx, line := range lines {
+		if line != expected[ndx] {
+			t.Errorf("Line %d of %s: expected %s, but was %s", ndx, url, expected[ndx], line)
+		}
+	}
+}
+
+type replayPacingTest struct {
+	query string
+	took  int64 // Nanoseconds the recording should take to play
+}
+
+var replayPacingTests = []replayPacingTest{
+	replayPacingTest{"", 200e6},
+	replayPacingTest{"?field=start_time&speed=20", 200e6},
+	replayPacingTest{"?field=start_time&speed=max", 0},
+}
+
+func TestReplayPacing(t *testing.T) {
+	fileName := writeFixture(t, replayFixture)
+	defer os.Remove(fileName)
+
+	for _, test := range replayPacingTests {
+		url := "replay://" + fileName + test.query
+		lines, took := playAll(t, url, "ranger")
+		checkReplayed(t, url, lines)
+		if took < test.took-20e6 || took > test.took+150e6 {
+			t.Errorf("Expected %s to take %.2fs, but it took %.2fs", url, float64(test.took)/1e9, float64(took)/1e9)
+		}
+	}
+}
+
+func TestReplaySpeedMustBePositive(t *testing.T) {
+	for _, speed := range []string{"0", "0.0", "-2"} {
+		if _, err := NewSource("replay:///tmp/ranger.jsonl?speed=" + speed); err == nil {
+			t.Errorf("Expected speed %s to be rejected", speed)
+		}
+	}
+}
+
+func TestReplayGzippedRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scribe_explorer")
+	if err != nil {
+		t.Fatalf("Couldn't create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logName := "ranger.jsonl.gz"
+	file, err := os.Create(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatalf("Couldn't create fixture: %v", err)
+	}
+	compressor, err := gzip.NewWriter(file)
+	if err != nil {
+		t.Fatalf("Couldn't compress fixture: %v", err)
+	}
+	compressor.Write([]byte(replayFixture))
+	compressor.Close()
+	file.Close()
+
+	// Either named directly, or as the log in a directory of recordings
+	for _, url := range []string{"replay://" + filepath.Join(dir, logName) + "?speed=max", "replay://" + dir + "?speed=max"} {
+		lines, _ := playAll(t, url, logName)
+		checkReplayed(t, url, lines)
+	}
+}
+
+func TestReplayFinishes(t *testing.T) {
+	fileName := writeFixture(t, replayFixture)
+	defer os.Remove(fileName)
+
+	source, err := NewSource("replay://" + fileName + "?speed=max")
+	if err != nil {
+		t.Fatalf("Couldn't create source: %v", err)
+	}
+	stream := NewDataStream("ranger", source, new(jsonDecoder))
+	request, _ := NewSubscribeRequest(16, DropNewest, 0)
+	stream.Subscribe(request)
+	defer stream.Unsubscribe(request)
+
+	for _, servlet := range []string{"home", "biz", "search"} {
+		select {
+		case data := <-request.dataChan:
+			if value, _ := GetDeep("servlet", data); value != servlet {
+				t.Errorf("Expected servlet %s, but was %v", servlet, value)
+			}
+		case <-time.After(5e9):
+			t.Fatalf("Timed out waiting for %s", servlet)
+		}
+	}
+
+	// Rather than reconnecting, the stream says it's done and stops
+	deadline := time.After(5e9)
+	for {
+		select {
+		case status := <-request.statusChan:
+			if status.State == StatusDegraded {
+				t.Errorf("Expected the replay to finish, but it was %s: %s", status.State, status.Message)
+			}
+			if status.State == StatusFinished {
+				waitForStop(t, stream)
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Timed out waiting for the replay to finish")
+		}
+	}
+}
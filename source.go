@@ -0,0 +1,292 @@
+package main
+
+import (
+	"exec"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Source knows how to open the raw, newline delimited upstream data for a named log.
+//
+// Sources are described by URLs and chosen by scheme:
+//
+//   scribe-tail://host:port    Connect to a scribe tailer and ask for the log by name
+//   unix:///path/to/socket     Same protocol as scribe-tail, but over a Unix socket
+//   file:///path/to/file       Follow a local file (or <dir>/<logName> if a directory is given)
+//   exec:///path/to/cmd args   Run a command with the log name as its last argument and read its stdout
+//   replay:///path/to/file     Play back a recording at its original pace (see replay.go)
+type Source interface {
+	Open(logName string) (stream io.ReadCloser, err os.Error)
+	String() string
+}
+
+// Sources that come to a natural end, like replays, rather than going away because something broke.
+// When a finite source runs out we stop instead of reconnecting.
+type FiniteSource interface {
+	Source
+	Finite() bool
+}
+
+func isFinite(source Source) bool {
+	finite, ok := source.(FiniteSource)
+	return ok && finite.Finite()
+}
+
+// Sources that should never go quiet for long, so silence means the connection is stuck. Files and
+// commands can be quiet for perfectly good reasons.
+type LiveSource interface {
+	Source
+	Live() bool
+}
+
+func isLive(source Source) bool {
+	live, ok := source.(LiveSource)
+	return ok && live.Live()
+}
+
+type sourceConstructor func(address string) (source Source, err os.Error)
+
+var sourceSchemes = map[string]sourceConstructor{
+	"scribe-tail": newTailerSource("tcp4"),
+	"unix":        newTailerSource("unix"),
+	"file":        newFileSource,
+	"exec":        newExecSource,
+	"replay":      newReplaySource,
+}
+
+func NewSource(url string) (source Source, err os.Error) {
+	sepNdx := strings.Index(url, "://")
+	if sepNdx < 0 {
+		return nil, fmt.Errorf("Source \"%s\" is not a URL", url)
+	}
+	scheme, address := url[:sepNdx], url[sepNdx+3:]
+
+	constructor, ok := sourceSchemes[scheme]
+	if !ok {
+		return nil, fmt.Errorf("Unknown source scheme '%s' in \"%s\"", scheme, url)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("Source \"%s\" is missing an address", url)
+	}
+	return constructor(address)
+}
+
+// Clients name sources in their queries, and anyone who can reach us is a client. So unless -query-sources says
+// otherwise they can't name any, and make do with the default source, "envs" and derived streams. Even then they
+// only get the scribe tailers we already know about and replays of our own recordings, never commands or whatever
+// file they like. The command line -source and -derived can use any.
+var querySchemes = flag.String("query-sources", "", "Source URL schemes queries and /admin/derive may name, separated by commas. Only scribe-tail (our own tailers) and replay (of -record-dir) are allowed")
+
+// A source named by a client, which has to use one of the -query-sources schemes.
+func NewQuerySource(url string) (source Source, err os.Error) {
+	allowed := false
+	for _, scheme := range strings.Split(*querySchemes, ",") {
+		if scheme = strings.TrimSpace(scheme); scheme != "" && strings.HasPrefix(url, scheme+"://") {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("Source \"%s\" isn't allowed in queries, -query-sources is \"%s\"", url, *querySchemes)
+	}
+
+	source, err = NewSource(url)
+	if err != nil {
+		return nil, err
+	}
+	switch s := source.(type) {
+	case *tailerSource:
+		if s.network == "tcp4" && isKnownTailer(s) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("Queries can only name the scribe tailers of our environments, not %v", s)
+	case *replaySource:
+		if inDir(*recordDir, s.path) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("Queries can only replay recordings in %s, not %s", *recordDir, s.path)
+	}
+	return nil, fmt.Errorf("Source \"%s\" isn't allowed in queries, only scribe-tail and replay sources can be", url)
+}
+
+// Whether path is dir or somewhere under it, once any ..s in it are resolved.
+func inDir(dir string, path string) bool {
+	dir, path = filepath.Clean(dir), filepath.Clean(path)
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// Where a log is kept by a source given a directory. Log names come from clients, so they can't lead out of it.
+func logFilePath(dir string, logName string) (path string, err os.Error) {
+	if logName == "" || strings.Contains(logName, "..") || strings.IndexAny(logName, "/"+string(filepath.Separator)) >= 0 {
+		return "", fmt.Errorf("Log name \"%s\" can't be used as a file name", logName)
+	}
+	return filepath.Join(dir, logName), nil
+}
+
+/*
+ * scribe-tail:// and unix://
+ *
+ * Dials the tailer, sends the log name followed by a newline and then reads whatever comes back.
+ */
+type tailerSource struct {
+	network string
+	address string
+}
+
+func newTailerSource(network string) sourceConstructor {
+	return func(address string) (source Source, err os.Error) {
+		return &tailerSource{network, address}, nil
+	}
+}
+
+func (s *tailerSource) Open(logName string) (stream io.ReadCloser, err os.Error) {
+	conn, err := net.Dial(s.network, s.address)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write([]uint8(logName + "\n"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *tailerSource) Live() bool {
+	return true
+}
+
+func (s *tailerSource) String() string {
+	if s.network == "unix" {
+		return "unix://" + s.address
+	}
+	return "scribe-tail://" + s.address
+}
+
+/*
+ * file://
+ *
+ * Reads a local file from the beginning, and then keeps following it like tail -f.
+ */
+type fileSource struct {
+	path string
+}
+
+// How long to wait for more data once we've caught up with the end of a followed file.
+const fileFollowInterval = 250e6
+
+func newFileSource(address string) (source Source, err os.Error) {
+	return &fileSource{address}, nil
+}
+
+func (s *fileSource) Open(logName string) (stream io.ReadCloser, err os.Error) {
+	path := s.path
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDirectory() {
+		if path, err = logFilePath(path, logName); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &followReader{file: file}, nil
+}
+
+func (s *fileSource) String() string {
+	return "file://" + s.path
+}
+
+type followReader struct {
+	file *os.File
+
+	lock   sync.Mutex // Close comes from whoever hangs up, not the goroutine reading
+	closed bool
+}
+
+func (f *followReader) Read(p []byte) (n int, err os.Error) {
+	for {
+		n, err = f.file.Read(p)
+		if err != os.EOF || n > 0 || f.isClosed() {
+			return
+		}
+		time.Sleep(fileFollowInterval)
+	}
+	return
+}
+
+func (f *followReader) isClosed() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.closed
+}
+
+func (f *followReader) Close() os.Error {
+	f.lock.Lock()
+	f.closed = true
+	f.lock.Unlock()
+	return f.file.Close()
+}
+
+/*
+ * exec://
+ *
+ * Runs a command and streams its stdout. The log name is appended as the final argument.
+ */
+type execSource struct {
+	command []string
+}
+
+func newExecSource(address string) (source Source, err os.Error) {
+	command := strings.Fields(address)
+	if len(command) == 0 {
+		return nil, fmt.Errorf("exec source needs a command")
+	}
+	return &execSource{command}, nil
+}
+
+func (s *execSource) Open(logName string) (stream io.ReadCloser, err os.Error) {
+	args := append(append([]string{}, s.command[1:]...), logName)
+	cmd := exec.Command(s.command[0], args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &execReader{stdout, cmd}, nil
+}
+
+func (s *execSource) String() string {
+	return "exec://" + strings.Join(s.command, " ")
+}
+
+type execReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (e *execReader) Close() os.Error {
+	// The process may well have already exited, we only care that it's gone.
+	if err := e.cmd.Process.Kill(); err != nil {
+		log.Printf("Failed to kill %v: %v", e.cmd.Args, err)
+	}
+	return e.cmd.Wait()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var sourceFixture = `{"servlet": "home", "timing": {"total": 12}}
+{"servlet": "biz", "timing": {"total": 40}}
+`
+
+type newSourceTest struct {
+	url string
+	str string
+	ok  bool
+}
+
+var newSourceTests = []newSourceTest{
+	newSourceTest{"scribe-tail://scribe-dev.local.yelpcorp.com:3535", "scribe-tail://scribe-dev.local.yelpcorp.com:3535", true},
+	newSourceTest{"unix:///var/run/tailer.sock", "unix:///var/run/tailer.sock", true},
+	newSourceTest{"file:///var/log/ranger", "file:///var/log/ranger", true},
+	newSourceTest{"exec:///usr/bin/tail -F", "exec:///usr/bin/tail -F", true},
+	newSourceTest{"replay:///tmp/ranger.jsonl", "replay:///tmp/ranger.jsonl?field=timestamp&speed=1", true},
+	newSourceTest{"replay:///tmp/ranger.jsonl?field=start_time&speed=10", "replay:///tmp/ranger.jsonl?field=start_time&speed=10", true},
+	newSourceTest{"replay:///tmp/ranger.jsonl?speed=max", "replay:///tmp/ranger.jsonl?field=timestamp&speed=max", true},
+	newSourceTest{"replay:///tmp/ranger.jsonl?speed=fast", "", false},
+	newSourceTest{"replay:///tmp/ranger.jsonl?speed=0", "", false},
+	newSourceTest{"replay:///tmp/ranger.jsonl?speed=-2", "", false},
+	newSourceTest{"scribe-dev.local.yelpcorp.com:3535", "", false},
+	newSourceTest{"gopher://localhost", "", false},
+	newSourceTest{"file://", "", false},
+}
+
+func TestNewSource(t *testing.T) {
+	for _, test := range newSourceTests {
+		source, err := NewSource(test.url)
+		if test.ok && err != nil {
+			t.Errorf("For url '%s', expected nil err, but was %v", test.url, err)
+			continue
+		}
+		if !test.ok {
+			if err == nil {
+				t.Errorf("For url '%s', expected err, but was nil", test.url)
+			}
+			continue
+		}
+		if source.String() != test.str {
+			t.Errorf("For url '%s', expected String() = %s, but was %s", test.url, test.str, source.String())
+		}
+	}
+}
+
+func TestQuerySourcesAreLimited(t *testing.T) {
+	if _, err := NewQuerySource("scribe-tail://scribe-dev.local.yelpcorp.com:3535"); err == nil {
+		t.Errorf("Expected queries not to be able to name any sources by default")
+	}
+
+	defer func(schemes string, dir string) { *querySchemes, *recordDir = schemes, dir }(*querySchemes, *recordDir)
+	*querySchemes, *recordDir = "scribe-tail, replay, file", "/tmp/recordings"
+	for url, ok := range map[string]bool{
+		"scribe-tail://scribe-dev.local.yelpcorp.com:3535": true,
+		"scribe-tail://10.0.0.1:22":                        false,
+		"replay:///tmp/recordings/ranger.jsonl.gz":         true,
+		"replay:///tmp/recordings?speed=max":               true,
+		"replay:///tmp/recordings/../../etc/passwd":        false,
+		"replay:///etc/passwd":                             false,
+		"exec:///bin/sh -c":                                false,
+		"file:///etc/passwd":                               false,
+		"unix:///var/run/tailer.sock":                      false,
+		"exec-scribe-tail://localhost":                     false,
+	} {
+		_, err := NewQuerySource(url)
+		if ok && err != nil {
+			t.Errorf("Expected a query to be able to use %s, got %v", url, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("Expected a query not to be able to use %s", url)
+		}
+	}
+}
+
+func writeFixture(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "scribe_explorer")
+	if err != nil {
+		t.Fatalf("Couldn't create fixture: %v", err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(contents)
+	if err != nil {
+		t.Fatalf("Couldn't write fixture: %v", err)
+	}
+	return file.Name()
+}
+
+func TestFileSourceDataStream(t *testing.T) {
+	fileName := writeFixture(t, sourceFixture)
+	defer os.Remove(fileName)
+
+	source, err := NewSource("file://" + fileName)
+	if err != nil {
+		t.Fatalf("Couldn't create source: %v", err)
+	}
+	stream := NewDataStream("ranger", source, new(jsonDecoder))
+
+	request := new(SubscribeRequest)
+	request.dataChan = make(chan JSONData, 16)
+	stream.Subscribe(request)
+	defer stream.Unsubscribe(request)
+
+	for _, servlet := range []string{"home", "biz"} {
+		data := <-request.dataChan
+		if value, _ := GetDeep("servlet", data); value != servlet {
+			t.Errorf("Expected servlet %s, but was %v", servlet, value)
+		}
+	}
+}
+
+func TestLogNamesStayInTheirDirectory(t *testing.T) {
+	fileName := writeFixture(t, sourceFixture)
+	defer os.Remove(fileName)
+	dir, logName := filepath.Split(fileName)
+
+	for _, url := range []string{"file://" + dir, "replay://" + dir + "?speed=max"} {
+		source, err := NewSource(url)
+		if err != nil {
+			t.Fatalf("Couldn't create source: %v", err)
+		}
+		if stream, err := source.Open(logName); err != nil {
+			t.Errorf("Expected %v to open %s, got %v", source, logName, err)
+		} else {
+			stream.Close()
+		}
+		for _, badName := range []string{"../" + logName, "..", "sub/" + logName, ""} {
+			if stream, err := source.Open(badName); err == nil {
+				stream.Close()
+				t.Errorf("Expected %v not to open '%s'", source, badName)
+			}
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"utf8"
+)
+
+/*
+ * Contains(s, substr string), StartsWith(s, prefix string), EndsWith(s, suffix string) -> bool
+ *
+ * A missing s contains, starts and ends with nothing.
+ */
+type StringPredicate struct {
+	expr  Expression
+	part  Expression
+	fname string
+}
+
+var stringPredicates = map[string](func(s, part string) bool){
+	"Contains":   func(s, part string) bool { return strings.Index(s, part) >= 0 },
+	"StartsWith": strings.HasPrefix,
+	"EndsWith":   strings.HasSuffix,
+}
+
+func (p *StringPredicate) Setup(fname string, args []Expression) (err os.Error) {
+	if _, ok := stringPredicates[fname]; !ok {
+		return fmt.Errorf("%v is not a supported StringPredicate", fname)
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("%s expects two arguments, a string and the string to look for in it", fname)
+	}
+	if err = checkLiteral(fname, args[1], "string"); err != nil {
+		return err
+	}
+	p.expr, p.part = args[0], args[1]
+	p.fname = fname
+	return nil
+}
+
+func (p *StringPredicate) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	s, present, err := evaluateString(p.fname, p.expr, data)
+	if err != nil {
+		return nil, err
+	}
+	part, partPresent, err := evaluateString(p.fname, p.part, data)
+	if err != nil {
+		return nil, err
+	}
+	if !present || !partPresent {
+		return false, nil
+	}
+	return stringPredicates[p.fname](s, part), nil
+}
+
+func (p *StringPredicate) String() string {
+	return fmt.Sprintf("%s(%v,%v)", p.fname, p.expr, p.part)
+}
+
+/*
+ * Lower(s string), Upper(s string), Trim(s string) -> string
+ *
+ * Trim takes off leading and trailing white space. A missing s stays missing.
+ */
+type StringTransform struct {
+	expr  Expression
+	fname string
+}
+
+var stringTransforms = map[string](func(s string) string){
+	"Lower": strings.ToLower,
+	"Upper": strings.ToUpper,
+	"Trim":  strings.TrimSpace,
+}
+
+func (t *StringTransform) Setup(fname string, args []Expression) (err os.Error) {
+	if _, ok := stringTransforms[fname]; !ok {
+		return fmt.Errorf("%v is not a supported StringTransform", fname)
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("%s expects a single argument, a string", fname)
+	}
+	if err = checkLiteral(fname, args[0], "string"); err != nil {
+		return err
+	}
+	t.expr = args[0]
+	t.fname = fname
+	return nil
+}
+
+func (t *StringTransform) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	s, present, err := evaluateString(t.fname, t.expr, data)
+	if err != nil || !present {
+		return nil, err
+	}
+	return stringTransforms[t.fname](s), nil
+}
+
+func (t *StringTransform) String() string {
+	return fmt.Sprintf("%s(%v)", t.fname, t.expr)
+}
+
+/*
+ * Substr(s string, start int[, length int]) -> string
+ *
+ * The characters of s from start (counting from 0) to the end, or length characters of them. A start or length
+ * past the end of s is cut short. A missing s stays missing.
+ */
+type Substr struct {
+	expr   Expression
+	start  Expression
+	length Expression
+}
+
+func (s *Substr) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("Substr expects a string, a start and optionally a length")
+	}
+	for _, arg := range args[1:] {
+		if err = checkLiteral(fname, arg, "non-negative int"); err != nil {
+			return err
+		}
+	}
+	s.expr, s.start = args[0], args[1]
+	if len(args) == 3 {
+		s.length = args[2]
+	}
+	return nil
+}
+
+func (s *Substr) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	str, present, err := evaluateString("Substr", s.expr, data)
+	if err != nil || !present {
+		return nil, err
+	}
+	chars := []int(str)
+
+	start, err := evaluateCount("Substr", s.start, data)
+	if err != nil {
+		return nil, err
+	}
+	if start > len(chars) {
+		start = len(chars)
+	}
+	end := len(chars)
+	if s.length != nil {
+		length, err := evaluateCount("Substr", s.length, data)
+		if err != nil {
+			return nil, err
+		}
+		// Not start+length, which a huge length would overflow
+		if length < end-start {
+			end = start + length
+		}
+	}
+	return string(chars[start:end]), nil
+}
+
+func (s *Substr) String() string {
+	if s.length != nil {
+		return fmt.Sprintf("Substr(%v,%v,%v)", s.expr, s.start, s.length)
+	}
+	return fmt.Sprintf("Substr(%v,%v)", s.expr, s.start)
+}
+
+/*
+ * Split(s string, separator string[, n int]) -> array, or string
+ *
+ * The parts of s between each separator, or just the nth of them (counting from 0), e.g.
+ * Split(uri, "?", 0) for the path of a uri. Asking for a part beyond the last gives nil, as does a missing s.
+ */
+type Split struct {
+	expr      Expression
+	separator Expression
+	index     Expression
+}
+
+func (s *Split) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("Split expects a string, a separator and optionally which part to return")
+	}
+	if err = checkLiteral(fname, args[1], "string"); err != nil {
+		return err
+	}
+	s.expr, s.separator = args[0], args[1]
+	if len(args) == 3 {
+		if err = checkLiteral(fname, args[2], "non-negative int"); err != nil {
+			return err
+		}
+		s.index = args[2]
+	}
+	return nil
+}
+
+func (s *Split) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	str, present, err := evaluateString("Split", s.expr, data)
+	if err != nil || !present {
+		return nil, err
+	}
+	separator, present, err := evaluateString("Split", s.separator, data)
+	if err != nil {
+		return nil, err
+	}
+	if !present || separator == "" {
+		return nil, fmt.Errorf("Split expects a non-empty separator")
+	}
+	parts := strings.Split(str, separator)
+
+	if s.index == nil {
+		// The same type JSON arrays decode to, so Len and the like treat them alike
+		result := make([]interface{}, len(parts))
+		for ndx, part := range parts {
+			result[ndx] = part
+		}
+		return result, nil
+	}
+	index, err := evaluateCount("Split", s.index, data)
+	if err != nil {
+		return nil, err
+	}
+	if index >= len(parts) {
+		return nil, nil
+	}
+	return parts[index], nil
+}
+
+func (s *Split) String() string {
+	if s.index != nil {
+		return fmt.Sprintf("Split(%v,%v,%v)", s.expr, s.separator, s.index)
+	}
+	return fmt.Sprintf("Split(%v,%v)", s.expr, s.separator)
+}
+
+/*
+ * Concat(a, b, ...) -> string
+ *
+ * Joins its arguments together. Numbers and bools are written as they'd print, and missing values are left out.
+ */
+type Concat struct {
+	args []Expression
+}
+
+func (c *Concat) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) < 2 {
+		return fmt.Errorf("Concat expects two or more arguments to join together")
+	}
+	c.args = args
+	return nil
+}
+
+func (c *Concat) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	parts := make([]string, 0, len(c.args))
+	for _, arg := range c.args {
+		value, err := arg.Evaluate(data)
+		if err != nil {
+			return nil, err
+		}
+		switch value := value.(type) {
+		case nil:
+		case string:
+			parts = append(parts, value)
+		case int, float64, bool:
+			str, _ := toString(value)
+			parts = append(parts, str.(string))
+		default:
+			return nil, fmt.Errorf("Concat can't join a %T, %v", value, arg)
+		}
+	}
+	return strings.Join(parts, ""), nil
+}
+
+func (c *Concat) String() string {
+	return fmt.Sprintf("Concat(%v)", joinExpressions(c.args))
+}
+
+/*
+ * Len(string, array or object) -> int
+ *
+ * The number of characters in a string, elements in an array or keys in an object. Missing values have none.
+ */
+type Len struct {
+	expr Expression
+}
+
+func (l *Len) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 1 {
+		return fmt.Errorf("Len expects a single argument, a string, array or object")
+	}
+	l.expr = args[0]
+	return nil
+}
+
+func (l *Len) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	value, err := l.expr.Evaluate(data)
+	if err != nil {
+		return nil, err
+	}
+	switch value := value.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		return utf8.RuneCountInString(value), nil
+	case []interface{}:
+		return len(value), nil
+	case map[string]interface{}:
+		return len(value), nil
+	}
+	return nil, fmt.Errorf("Len expects a string, array or object, %v was %T %v", l.expr, value, value)
+}
+
+func (l *Len) String() string {
+	return fmt.Sprintf("Len(%v)", l.expr)
+}
+
+/*
+ * Replace(s string, old string, new string) -> string
+ *
+ * Replaces every old in s with new. A missing s stays missing.
+ */
+type Replace struct {
+	expr        Expression
+	old         Expression
+	replacement Expression
+}
+
+func (r *Replace) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 3 {
+		return fmt.Errorf("Replace expects three arguments, a string, what to replace and what to replace it with")
+	}
+	for _, arg := range args[1:] {
+		if err = checkLiteral(fname, arg, "string"); err != nil {
+			return err
+		}
+	}
+	r.expr, r.old, r.replacement = args[0], args[1], args[2]
+	return nil
+}
+
+func (r *Replace) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	s, present, err := evaluateString("Replace", r.expr, data)
+	if err != nil || !present {
+		return nil, err
+	}
+	old, present, err := evaluateString("Replace", r.old, data)
+	if err != nil {
+		return nil, err
+	}
+	if !present || old == "" {
+		return nil, fmt.Errorf("Replace expects a non-empty string to replace")
+	}
+	replacement, _, err := evaluateString("Replace", r.replacement, data)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Replace(s, old, replacement, -1), nil
+}
+
+func (r *Replace) String() string {
+	return fmt.Sprintf("Replace(%v,%v,%v)", r.expr, r.old, r.replacement)
+}
+
+// Evaluates to a string. A missing (nil) value isn't an error, but isn't present either.
+func evaluateString(fname string, expr Expression, data JSONData) (result string, present bool, err os.Error) {
+	value, err := expr.Evaluate(data)
+	if err != nil || value == nil {
+		return "", false, err
+	}
+	result, ok := value.(string)
+	if !ok {
+		return "", false, fmt.Errorf("%s expects a string, but %v was %T %v", fname, expr, value, value)
+	}
+	return result, true, nil
+}
+
+// Evaluates to a non-negative int, like a position or length. Whole numbers from JSON count.
+func evaluateCount(fname string, expr Expression, data JSONData) (result int, err os.Error) {
+	value, err := expr.Evaluate(data)
+	if err != nil {
+		return 0, err
+	}
+	if count, ok := countValue(value); ok {
+		return count, nil
+	}
+	return 0, fmt.Errorf("%s expects a non-negative int, but %v was %T %v", fname, expr, value, value)
+}
+
+// Catches literal arguments of the wrong type when the statement is parsed, rather than on every event.
+func checkLiteral(fname string, arg Expression, wanted string) (err os.Error) {
+	literal, ok := arg.(*Literal)
+	if !ok {
+		return nil
+	}
+	switch wanted {
+	case "string":
+		_, ok = literal.value.(string)
+	case "non-negative int":
+		_, ok = countValue(literal.value)
+	}
+	if !ok {
+		return fmt.Errorf("%s expects a %s, got %T %v", fname, wanted, literal.value, literal.value)
+	}
+	return nil
+}
+
+func joinExpressions(exprs []Expression) string {
+	strs := make([]string, len(exprs))
+	for ndx, expr := range exprs {
+		strs[ndx] = expr.String()
+	}
+	return strings.Join(strs, ",")
+}
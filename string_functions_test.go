@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+)
+
+var stringFunctionTests = []expressionTest{
+	expressionTest{`Contains(uri, "/biz/")`, true, true},
+	expressionTest{`Contains(uri, "/user/")`, false, true},
+	expressionTest{`StartsWith(uri, "/biz")`, true, true},
+	expressionTest{`EndsWith(uri, "?osq=pizza")`, true, true},
+	expressionTest{`EndsWith(Lower(agent), "bot")`, true, true},
+	expressionTest{`Contains(not_there, "x")`, false, true},
+	expressionTest{`Contains(status, "2")`, nil, false},
+
+	expressionTest{"Lower(agent)", "googlebot", true},
+	expressionTest{"Upper(servlet)", "HOME", true},
+	expressionTest{"Trim(padded)", "spaced out", true},
+	expressionTest{"Lower(not_there)", nil, true},
+	expressionTest{"Upper(status)", nil, false},
+
+	expressionTest{"Substr(servlet, 1)", "ome", true},
+	expressionTest{"Substr(servlet, 1, 2)", "om", true},
+	expressionTest{"Substr(servlet, 2, 100)", "me", true},
+	expressionTest{"Substr(servlet, 1, 9223372036854775807)", "ome", true},
+	expressionTest{"Substr(servlet, 1, huge)", "ome", true},
+	expressionTest{"Substr(servlet, 10)", "", true},
+	expressionTest{"Substr(name, 0, 4)", "Café", true},
+	expressionTest{"Substr(servlet, status)", "", true},
+	expressionTest{"Substr(not_there, 1)", nil, true},
+	expressionTest{"Substr(servlet, half)", nil, false},
+
+	expressionTest{`Split(uri, "?", 0)`, "/biz/pizza-place", true},
+	expressionTest{`Split(uri, "/", 2)`, "pizza-place?osq=pizza", true},
+	expressionTest{`Split(uri, "?", 5)`, nil, true},
+	expressionTest{`Split(servlet, "o")`, []interface{}{"h", "me"}, true},
+	expressionTest{`Split(not_there, "o")`, nil, true},
+	expressionTest{`Split(servlet, not_there)`, nil, false},
+
+	expressionTest{`Concat(servlet, ":", status)`, "home:200", true},
+	expressionTest{`Concat(servlet, not_there, "!")`, "home!", true},
+	expressionTest{`Concat(servlet, timing)`, nil, false},
+
+	expressionTest{"Len(servlet)", 4, true},
+	expressionTest{"Len(name)", 5, true},
+	expressionTest{"Len(timing)", 2, true},
+	expressionTest{`Len(Split(uri, "/"))`, 3, true},
+	expressionTest{"Len(not_there)", 0, true},
+	expressionTest{"Len(status)", nil, false},
+	expressionTest{`Len(servlet) == 4`, true, true},
+
+	expressionTest{`Replace(uri, "pizza", "tacos")`, "/biz/tacos-place?osq=tacos", true},
+	expressionTest{`Replace(servlet, "x", "y")`, "home", true},
+	expressionTest{`Replace(not_there, "x", "y")`, nil, true},
+	expressionTest{`Replace(servlet, not_there, "y")`, nil, false},
+}
+
+func TestStringFunctions(t *testing.T) {
+	event := `{"servlet": "home", "status": 200, "half": 0.5, "huge": 1e18, "name": "Cafés", "padded": "  spaced out\n",
+		"uri": "/biz/pizza-place?osq=pizza", "agent": "GoogleBot", "timing": {"total": 612.5, "backend": 200}}`
+	checkExpressions(t, event, stringFunctionTests)
+}
+
+func TestStringFunctionSetup(t *testing.T) {
+	for _, statement := range []string{
+		"Contains(uri)",
+		`Contains(uri, 5)`,
+		`Lower("a", "b")`,
+		"Lower(5)",
+		"Substr(servlet)",
+		"Substr(servlet, -1)",
+		"Substr(servlet, 1.5)",
+		`Substr(servlet, "1")`,
+		"Split(uri, 1)",
+		`Split(uri, "/", "1")`,
+		"Concat(servlet)",
+		"Len()",
+		`Replace(uri, "a")`,
+		`Replace(uri, "a", 1)`,
+	} {
+		if expr, err := Parse(statement); err == nil {
+			t.Errorf("Expected an error parsing %s, got %v", statement, expr)
+		}
+	}
+}
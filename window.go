@@ -4,6 +4,7 @@ import (
 	"os"
 	"fmt"
 	"container/list"
+	"strconv"
 	"time"
 )
 
@@ -66,12 +67,12 @@ func (rw *RollingWindow) Evaluate(data JSONData) (result interface{}, err os.Err
 	if err != nil {
 		return nil, err
 	}
-	wSize, ok := wSize.(int)
+	size, ok := countValue(wSize)
 	if !ok {
-		return nil, fmt.Errorf("RollingWindow expects an int window size. Got a %T, %v", wSize, wSize)
+		return nil, fmt.Errorf("RollingWindow expects a whole number window size. Got a %T, %v", wSize, wSize)
 	}
 	if value != nil {
-		err = rw.Push(value, wSize.(int))
+		err = rw.Push(value, size)
 	}
 	return rw.windowList.Front(), err
 }
@@ -94,16 +95,24 @@ func (rw *RollingWindow) Push(element interface{}, wSize int) (err os.Error) {
 	return
 }
 
+/*
+ * TimedWindow(expr, seconds int[, EventTime(...)])
+ *
+ * Holds the values of expr from the last so many seconds. By default that's by our clock, as events
+ * arrive. Given an EventTime it's by the events' own timestamps instead.
+ */
 type TimedWindow struct {
 	expr         Expression
-	windowList   list.List
+	windowList   list.List // timedWindowElement, newest at the front
 	windowLength Expression
+	eventTime    *EventTime
 	listener     WindowListener
+	late         int64 // Events that arrived too far behind the newest to be let in, since the last TakeLate()
 }
 
 type timedWindowElement struct {
 	value     interface{}
-	timestamp int64
+	timestamp float64 // Unix seconds
 }
 
 var _ Window = new(TimedWindow)
@@ -113,15 +122,25 @@ func (tw *TimedWindow) Len() int {
 }
 
 func (tw *TimedWindow) String() string {
+	if tw.eventTime != nil {
+		return fmt.Sprintf("TimedWindow(%v,%v,%v)", tw.expr, tw.windowLength, tw.eventTime)
+	}
 	return fmt.Sprintf("TimedWindow(%v,%v)", tw.expr, tw.windowLength)
 }
 
 func (tw *TimedWindow) Setup(fname string, args []Expression) (err os.Error) {
-	if len(args) != 2 {
-		return fmt.Errorf("RollingWindow must have 2 args, the element and a positive int window size. Got %v", args)
+	if len(args) != 2 && len(args) != 3 {
+		return fmt.Errorf("TimedWindow must have 2 or 3 args, the element, a positive int window size and optionally an EventTime. Got %v", args)
 	}
 	tw.expr = args[0]
 	tw.windowLength = args[1]
+	if len(args) == 3 {
+		eventTime, ok := args[2].(*EventTime)
+		if !ok {
+			return fmt.Errorf("TimedWindow expects an EventTime as its third argument. Got %v", args[2])
+		}
+		tw.eventTime = eventTime
+	}
 
 	return nil
 }
@@ -140,19 +159,59 @@ func (tw *TimedWindow) Evaluate(data JSONData) (result interface{}, err os.Error
 	if err != nil {
 		return nil, err
 	}
-	wSize, ok := wSize.(int)
+	size, ok := countValue(wSize)
 	if !ok {
-		return nil, fmt.Errorf("RollingWindow expects an int (number of seconds) window size. Got a %T, %v", wSize, wSize)
+		return nil, fmt.Errorf("TimedWindow expects a whole number of seconds window size. Got a %T, %v", wSize, wSize)
 	}
-	if value != nil {
-		err = tw.Push(value, wSize.(int))
+	if value == nil {
+		return tw.windowList.Front(), nil
+	}
+
+	if tw.eventTime == nil {
+		err = tw.Push(value, size)
+	} else {
+		at, timeErr := tw.eventTime.Evaluate(data)
+		if timeErr != nil {
+			return nil, timeErr
+		}
+		lateness, latenessErr := tw.eventTime.Lateness(data)
+		if latenessErr != nil {
+			return nil, latenessErr
+		}
+		err = tw.pushAt(value, size, at.(float64), lateness)
 	}
 	return tw.windowList.Front(), err
 }
 
+// Returns how many events were too late to be let in since the last call.
+func (tw *TimedWindow) TakeLate() (late int64) {
+	late, tw.late = tw.late, 0
+	return late
+}
+
+// Pushes an element that's happening now, by our clock.
 func (tw *TimedWindow) Push(element interface{}, wSize int) (err os.Error) {
-	now := time.Seconds()
-	tw.windowList.PushFront(timedWindowElement{element, now})
+	return tw.pushAt(element, wSize, float64(time.Nanoseconds())/1e9, 0)
+}
+
+// Pushes an element that happened at the given time (in unix seconds), in its place among the others. Elements
+// more than lateness seconds behind the newest are too late to be let in.
+func (tw *TimedWindow) pushAt(element interface{}, wSize int, at float64, lateness float64) (err os.Error) {
+	if newest := tw.windowList.Front(); newest != nil && at < newest.Value.(timedWindowElement).timestamp-lateness {
+		tw.late++
+		return nil
+	}
+
+	// Almost everything arrives in order, so look for its place from the newest end.
+	mark := tw.windowList.Front()
+	for mark != nil && mark.Value.(timedWindowElement).timestamp > at {
+		mark = mark.Next()
+	}
+	if mark == nil {
+		tw.windowList.PushBack(timedWindowElement{element, at})
+	} else {
+		tw.windowList.InsertBefore(timedWindowElement{element, at}, mark)
+	}
 	if tw.listener != nil {
 		err = tw.listener.Push(element)
 	}
@@ -161,7 +220,7 @@ func (tw *TimedWindow) Push(element interface{}, wSize int) (err os.Error) {
 	}
 
 	// Now trim off any elements that occured before the beginning of the window.
-	windowStart := now - int64(wSize)
+	windowStart := tw.windowList.Front().Value.(timedWindowElement).timestamp - float64(wSize)
 	for {
 		backElem := tw.windowList.Back()
 		if backElem == nil {
@@ -180,6 +239,78 @@ func (tw *TimedWindow) Push(element interface{}, wSize int) (err os.Error) {
 	return
 }
 
+/*
+ * EventTime(string[, allowed lateness in seconds]) -> float64
+ *
+ * When an event happened, in unix seconds, from the field at the given GetDeep path, e.g. EventTime("start_time").
+ * Given to a TimedWindow it makes the window keep to the events' clock rather than ours, so it still makes sense
+ * during a replay or after upstream lag. Events arriving more than the allowed lateness (5 seconds unless
+ * given) behind the newest one in the window are left out.
+ */
+type EventTime struct {
+	path     Expression
+	lateness Expression
+}
+
+const defaultAllowedLateness = 5
+
+func (e *EventTime) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("EventTime expects a string GetDeep path to the event's timestamp, and optionally an allowed lateness in seconds")
+	}
+	e.path = args[0]
+	if len(args) == 2 {
+		e.lateness = args[1]
+	} else {
+		e.lateness = &Literal{defaultAllowedLateness}
+	}
+	return nil
+}
+
+func (e *EventTime) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	path, err := e.path.Evaluate(data)
+	if err != nil {
+		return nil, err
+	}
+	if path, ok := path.(string); path == "" || !ok {
+		return nil, fmt.Errorf("EventTime expects a non-empty string path. Was type %T \"%v\"", path, path)
+	}
+	value, _ := GetDeep(path.(string), data)
+	seconds, ok := unixSeconds(value)
+	if !ok {
+		return nil, fmt.Errorf("Expected a unix timestamp at %v, got %T %v", path, value, value)
+	}
+	return seconds, nil
+}
+
+// How far behind the newest event, in seconds, an event can be and still count.
+func (e *EventTime) Lateness(data JSONData) (lateness float64, err os.Error) {
+	value, err := e.lateness.Evaluate(data)
+	if err != nil {
+		return 0, err
+	}
+	if lateness, ok := numberValue(value); ok {
+		return lateness, nil
+	}
+	return 0, fmt.Errorf("EventTime expects a number of seconds of allowed lateness. Got a %T, %v", value, value)
+}
+
+func (e *EventTime) String() string {
+	return fmt.Sprintf("EventTime(%v,%v)", e.path, e.lateness)
+}
+
+// Timestamps are unix seconds, either as numbers or as strings of them.
+func unixSeconds(value interface{}) (seconds float64, ok bool) {
+	switch value := value.(type) {
+	case int, float64:
+		return numberValue(value)
+	case string:
+		seconds, err := strconv.Atof64(value)
+		return seconds, err == nil
+	}
+	return 0, false
+}
+
 type WindowAve struct {
 	window Window
 	sum    float64
@@ -209,21 +340,78 @@ func (wa *WindowAve) Evaluate(data JSONData) (result interface{}, err os.Error)
 }
 
 func (wa *WindowAve) Push(val interface{}) (err os.Error) {
-	if val, ok := val.(float64); !ok {
-		return fmt.Errorf("Window expected a float64, got %v (%T)", val, val)
+	number, ok := numberValue(val)
+	if !ok {
+		return fmt.Errorf("Window expected a number, got %v (%T)", val, val)
 	}
-	wa.sum += val.(float64)
+	wa.sum += number
 	return nil
 }
 
 func (wa *WindowAve) Pop(val interface{}) (err os.Error) {
-	if val, ok := val.(float64); !ok {
-		return fmt.Errorf("Window expected a float64, got %v (%T)", val, val)
+	number, ok := numberValue(val)
+	if !ok {
+		return fmt.Errorf("Window expected a number, got %v (%T)", val, val)
 	}
-	wa.sum -= val.(float64)
+	wa.sum -= number
 	return nil
 }
 
 func (wa *WindowAve) String() string {
 	return fmt.Sprintf("WindowAve(%v)", wa.window)
 }
+
+/*
+ * WindowSum(Window) -> float64
+ *
+ * Sums the window. On a stream that's shedding load, WindowSum(TimedWindow(_weight, 60)) estimates how many
+ * events there were in the last minute, counting each kept event as the events it stands for.
+ */
+type WindowSum struct {
+	window Window
+	sum    float64
+}
+
+var _ WindowListener = new(WindowSum)
+
+func (ws *WindowSum) Setup(fname string, args []Expression) (err os.Error) {
+	if len(args) != 1 {
+		return fmt.Errorf("WindowSum expects a single Window argument.")
+	}
+	window, ok := args[0].(Window)
+	if !ok {
+		return fmt.Errorf("WindowSum expects a single Window argument.")
+	}
+	ws.window = window
+	ws.window.SetListener(ws)
+	return
+}
+
+func (ws *WindowSum) Evaluate(data JSONData) (result interface{}, err os.Error) {
+	if _, err = ws.window.Evaluate(data); err != nil {
+		return nil, err
+	}
+	return ws.sum, nil
+}
+
+func (ws *WindowSum) Push(val interface{}) (err os.Error) {
+	number, ok := numberValue(val)
+	if !ok {
+		return fmt.Errorf("Window expected a number, got %v (%T)", val, val)
+	}
+	ws.sum += number
+	return nil
+}
+
+func (ws *WindowSum) Pop(val interface{}) (err os.Error) {
+	number, ok := numberValue(val)
+	if !ok {
+		return fmt.Errorf("Window expected a number, got %v (%T)", val, val)
+	}
+	ws.sum -= number
+	return nil
+}
+
+func (ws *WindowSum) String() string {
+	return fmt.Sprintf("WindowSum(%v)", ws.window)
+}
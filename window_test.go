@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+)
+
+type timedEvent struct {
+	startTime interface{} // Timestamps as strings work too
+	value     float64
+	sum       float64 // Of the window after this event
+}
+
+// A 10 second window on start_time with 3 seconds of allowed lateness
+var eventTimeTests = []timedEvent{
+	timedEvent{100.0, 1, 1},
+	timedEvent{"105", 2, 3},
+	timedEvent{103.0, 4, 7},   // Out of order, but within the lateness
+	timedEvent{"101", 8, 7},   // Too late
+	timedEvent{112.0, 16, 22}, // 100 falls out of the window
+	timedEvent{130.0, 32, 32}, // Everything else does
+}
+
+func TestTimedWindowEventTime(t *testing.T) {
+	eventTime := new(EventTime)
+	if err := eventTime.Setup("EventTime", []Expression{&Literal{"start_time"}, &Literal{3}}); err != nil {
+		t.Fatalf("Couldn't set up EventTime: %v", err)
+	}
+	value, _ := NewGetDeepExpression("value")
+	window := new(TimedWindow)
+	if err := window.Setup("TimedWindow", []Expression{value, &Literal{10}, eventTime}); err != nil {
+		t.Fatalf("Couldn't set up TimedWindow: %v", err)
+	}
+	sum := new(WindowSum)
+	sum.Setup("WindowSum", []Expression{window})
+
+	for ndx, test := range eventTimeTests {
+		result, err := sum.Evaluate(map[string]interface{}{"start_time": test.startTime, "value": test.value})
+		if err != nil {
+			t.Fatalf("Event %d: unexpected err %v", ndx, err)
+		}
+		if result != test.sum {
+			t.Errorf("Event %d: expected the window to sum to %v, but was %v", ndx, test.sum, result)
+		}
+	}
+	if late := window.TakeLate(); late != 1 {
+		t.Errorf("Expected 1 late event, but was %d", late)
+	}
+	if late := window.TakeLate(); late != 0 {
+		t.Errorf("Expected taking the late events to reset them, but there were %d more", late)
+	}
+
+	if _, err := sum.Evaluate(map[string]interface{}{"value": 1.0}); err == nil {
+		t.Errorf("Expected an event without a start_time to be an error")
+	}
+}
+
+func TestTimedWindowNeedsEventTime(t *testing.T) {
+	value, _ := NewGetDeepExpression("value")
+	window := new(TimedWindow)
+	if err := window.Setup("TimedWindow", []Expression{value, &Literal{10}, value}); err == nil {
+		t.Errorf("Expected a third argument other than EventTime to be rejected")
+	}
+}
+
+func TestQueryTakesLateEvents(t *testing.T) {
+	query := NewScribeQuery(
+		[]interface{}{`WindowSum(TimedWindow(value, 10, EventTime("start_time", 3)))`},
+		[]interface{}{`WindowSum(TimedWindow(value, 10, EventTime("start_time", 0))) >= 0`})
+	for ndx, test := range eventTimeTests {
+		if _, _, err := query.Evaluate(map[string]interface{}{"start_time": test.startTime, "value": test.value}); err != nil {
+			t.Fatalf("Event %d: unexpected err %v", ndx, err)
+		}
+	}
+
+	// The filter's window allows no lateness, so it leaves out the out of order event as well
+	if late := query.TakeLate(); late != 3 {
+		t.Errorf("Expected 3 late events from the query's windows, but was %d", late)
+	}
+	if late := query.TakeLate(); late != 0 {
+		t.Errorf("Expected taking the late events to reset them, but there were %d more", late)
+	}
+}